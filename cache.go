@@ -91,11 +91,15 @@ const (
     REDIS_COMMAND_ZREMRANGEBYSCORE = "zremrangebyscore"
     REDIS_COMMAND_ZREVRANK         = "zrevrank"
     REDIS_COMMAND_ZSCORE           = "zscore"
+    REDIS_COMMAND_INFO             = "info"
+    REDIS_COMMAND_MEMORY           = "memory"
+    REDIS_COMMAND_DBSIZE           = "dbsize"
 )
 
 var ErrorArgsLength = errors.Errorf("parameter number mismatch")
 var ErrorKeyNotFound = errors.Errorf("the specified key does not exist")
 var ErrorTypeNotMatch = errors.Errorf("the data type of the specified key do not match")
+var ErrorCommandNotSupported = errors.Errorf("command is not supported")
 
 type SetData struct {
     data   set.Set
@@ -134,6 +138,7 @@ type IPoolData interface {
     BuildSet(...interface{})
     GetSrcData() interface{}
     Incr(int64)
+    GetMemoryUsage() int64
 }
 
 type StandardData struct {
@@ -197,6 +202,12 @@ func (s *StandardData) Incr(add int64) {
     }
 }
 
+func (s *StandardData) GetMemoryUsage() int64 {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    return memoryOverheadStandard + estimateValueSize(s.data)
+}
+
 func (s *StandardData) AppendValue(interface{})                          {}
 func (s *StandardData) RemoveMutil(...interface{}) int                   { return -1 }
 func (s *StandardData) PeekValues(int) []interface{}                     { return []interface{}{} }
@@ -301,6 +312,16 @@ func (s *MapData) GetValues() []interface{} {
     return ks
 }
 
+func (s *MapData) GetMemoryUsage() int64 {
+    s.check()
+    var size int64 = memoryOverheadMap
+    s.data.Range(func(key, value interface{}) bool {
+        size += memoryOverheadEntry + estimateValueSize(key) + estimateValueSize(value)
+        return true
+    })
+    return size
+}
+
 func (s *MapData) AppendValue(interface{})                          {}
 func (s *MapData) RemoveMutil(...interface{}) int                   { return -1 }
 func (s *MapData) PeekValues(int) []interface{}                     { return []interface{}{} }
@@ -493,6 +514,17 @@ func (s *ListData) AppendValue(v interface{}) {
     s.data = append(s.data, v)
 }
 
+func (s *ListData) GetMemoryUsage() int64 {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    s.check()
+    var size int64 = memoryOverheadList
+    for _, v := range s.data {
+        size += memoryOverheadInterface + estimateValueSize(v)
+    }
+    return size
+}
+
 func (s *ListData) RemoveMutil(...interface{}) int               { return -1 }
 func (s *ListData) PeekValues(int) []interface{}                 { return []interface{}{} }
 func (s *ListData) PopValues(int) []interface{}                  { return []interface{}{} }
@@ -649,6 +681,16 @@ func (s *SetData) RemoveMutil(vs ...interface{}) int {
     return c
 }
 
+func (s *SetData) GetMemoryUsage() int64 {
+    s.check()
+    var size int64 = memoryOverheadSet
+    s.data.Each(func(v interface{}) bool {
+        size += memoryOverheadEntry + estimateValueSize(v)
+        return false
+    })
+    return size
+}
+
 func (s *SetData) AppendValue(interface{})                          {}
 func (s *SetData) Incr(int64)                                       {}
 func (s *SetData) GetSrcData() interface{}                          { return s.data }
@@ -694,20 +736,46 @@ func tryParseInt64(v interface{}) int64 {
 }
 
 type LocalFastRedis struct {
-    dataPool *sync.Map
+    dataPool    *sync.Map
+    stats       *cacheStats
+    replication cacheReplication
 }
 
-func (r *LocalFastRedis) OpenConn(uint64) bool {
+func (r *LocalFastRedis) OpenConn(uint64, string) bool {
     return true
 }
 
 func (r *LocalFastRedis) CloseConn(uint64) {}
 
+func (r *LocalFastRedis) CloseOwnerConns(string) {}
+
 func (r *LocalFastRedis) InitPool(config RedisConfig) {
     r.dataPool = new(sync.Map)
+    r.stats = createCacheStats()
+    r.initReplication(config.Replication)
 }
 
 func (r *LocalFastRedis) Do(cmd string, args ...interface{}) (interface{}, error) {
+    lcmd := strings.ToLower(cmd)
+    st := time.Now()
+    var ret interface{}
+    var err error
+    if r.replication != nil && localWriteCommands[lcmd] {
+        ret, err = r.replication.apply(lcmd, args)
+    } else {
+        ret, err = r.execute(lcmd, args...)
+    }
+    //不支持的命令不计入统计, 避免客户端发送的任意命令名使统计无限增长
+    if err != ErrorCommandNotSupported {
+        r.stats.recordCommand(lcmd, st)
+    }
+    if localReadCommands[lcmd] {
+        r.stats.lookup(ret, err)
+    }
+    return ret, err
+}
+
+func (r *LocalFastRedis) execute(cmd string, args ...interface{}) (interface{}, error) {
     switch strings.ToLower(cmd) {
     case REDIS_COMMAND_GET:
         if len(args) == 1 {
@@ -1410,19 +1478,37 @@ func (r *LocalFastRedis) Do(cmd string, args ...interface{}) (interface{}, error
         } else {
             return 0, ErrorArgsLength
         }
+    case REDIS_COMMAND_DBSIZE:
+        return r.dbSize(), nil
+    case REDIS_COMMAND_INFO:
+        section := ""
+        if len(args) > 0 {
+            section = fmt.Sprint(args[0])
+        }
+        return r.info(section), nil
+    case REDIS_COMMAND_MEMORY:
+        if len(args) >= 2 && strings.ToLower(fmt.Sprint(args[0])) == "usage" {
+            m := r.getData(args[1])
+            if m != nil {
+                return m.GetMemoryUsage() + estimateValueSize(args[1]), nil
+            }
+            return nil, nil
+        } else {
+            return nil, ErrorArgsLength
+        }
     }
-    return nil, fmt.Errorf("command is not supported")
+    return nil, ErrorCommandNotSupported
 }
 
-func (r *LocalFastRedis) Send(uint64, string, ...interface{}) error {
+func (r *LocalFastRedis) Send(uint64, string, string, ...interface{}) error {
     return nil
 }
 
-func (r *LocalFastRedis) Flush(uint64) error {
+func (r *LocalFastRedis) Flush(uint64, string) error {
     return nil
 }
 
-func (r *LocalFastRedis) Receive(uint64) (interface{}, error) {
+func (r *LocalFastRedis) Receive(uint64, string) (interface{}, error) {
     return nil, nil
 }
 
@@ -1435,6 +1521,7 @@ func (r *LocalFastRedis) getData(k interface{}) IPoolData {
                 return d
             } else {
                 r.dataPool.Delete(k)
+                r.stats.expire()
             }
         }
     }
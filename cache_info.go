@@ -0,0 +1,292 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    set "github.com/deckarep/golang-set"
+    "github.com/packing/clove/codecs"
+)
+
+//估算内存占用时使用的固定开销(字节), 与 Go 运行时的实际布局近似即可
+const (
+    memoryOverheadInterface = 16
+    memoryOverheadEntry     = 48
+    memoryOverheadStandard  = 64
+    memoryOverheadMap       = 96
+    memoryOverheadList      = 96
+    memoryOverheadSet       = 96
+)
+
+type commandStat struct {
+    calls int64
+    usec  int64
+}
+
+type cacheStats struct {
+    hits     int64
+    misses   int64
+    expired  int64
+    evicted  int64
+    commands int64
+    started  time.Time
+    mutex    sync.Mutex
+    cmdStats map[string]*commandStat
+}
+
+func createCacheStats() *cacheStats {
+    s := new(cacheStats)
+    s.started = time.Now()
+    s.cmdStats = make(map[string]*commandStat)
+    return s
+}
+
+func (s *cacheStats) hit() {
+    if s != nil {
+        atomic.AddInt64(&s.hits, 1)
+    }
+}
+
+func (s *cacheStats) miss() {
+    if s != nil {
+        atomic.AddInt64(&s.misses, 1)
+    }
+}
+
+//只读命令, 只有这些命令计入 keyspace_hits/keyspace_misses
+var localReadCommands = map[string]bool{
+    REDIS_COMMAND_GET:         true,
+    REDIS_COMMAND_STRLEN:      true,
+    REDIS_COMMAND_MGET:        true,
+    REDIS_COMMAND_HGET:        true,
+    REDIS_COMMAND_HMGET:       true,
+    REDIS_COMMAND_HGETALL:     true,
+    REDIS_COMMAND_HEXISTS:     true,
+    REDIS_COMMAND_HKEYS:       true,
+    REDIS_COMMAND_HVALS:       true,
+    REDIS_COMMAND_HLEN:        true,
+    REDIS_COMMAND_LLEN:        true,
+    REDIS_COMMAND_LINDEX:      true,
+    REDIS_COMMAND_LRANGE:      true,
+    REDIS_COMMAND_SCARD:       true,
+    REDIS_COMMAND_SDIFF:       true,
+    REDIS_COMMAND_SINTER:      true,
+    REDIS_COMMAND_SISMEMBER:   true,
+    REDIS_COMMAND_SMEMBERS:    true,
+    REDIS_COMMAND_SRANDMEMBER: true,
+    REDIS_COMMAND_SUNION:      true,
+    REDIS_COMMAND_ZCARD:       true,
+    REDIS_COMMAND_ZCOUNT:      true,
+    REDIS_COMMAND_ZRANGE:      true,
+    REDIS_COMMAND_ZRANK:       true,
+    REDIS_COMMAND_ZREVRANK:    true,
+    REDIS_COMMAND_ZSCORE:      true,
+}
+
+//lookup 按只读命令的结果计数: 找不到key为未命中, 成功读到数据为命中, 其他错误不计
+func (s *cacheStats) lookup(ret interface{}, err error) {
+    if err == ErrorKeyNotFound || (err == nil && ret == nil) {
+        s.miss()
+    } else if err == nil {
+        s.hit()
+    }
+}
+
+func (s *cacheStats) expire() {
+    if s != nil {
+        atomic.AddInt64(&s.expired, 1)
+    }
+}
+
+func (s *cacheStats) evict() {
+    if s != nil {
+        atomic.AddInt64(&s.evicted, 1)
+    }
+}
+
+func (s *cacheStats) recordCommand(cmd string, st time.Time) {
+    if s == nil {
+        return
+    }
+    atomic.AddInt64(&s.commands, 1)
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    c, ok := s.cmdStats[cmd]
+    if !ok {
+        c = new(commandStat)
+        s.cmdStats[cmd] = c
+    }
+    c.calls += 1
+    c.usec += time.Since(st).Microseconds()
+}
+
+func estimateValueSize(v interface{}) int64 {
+    switch d := v.(type) {
+    case nil:
+        return 0
+    case string:
+        return int64(len(d)) + 16
+    case []byte:
+        return int64(len(d)) + 24
+    case bool, int8, uint8:
+        return 1
+    case int16, uint16:
+        return 2
+    case int32, uint32, float32:
+        return 4
+    case int, uint, int64, uint64, float64:
+        return 8
+    case codecs.IMSlice:
+        var size int64 = 24
+        for _, e := range d {
+            size += memoryOverheadInterface + estimateValueSize(e)
+        }
+        return size
+    case codecs.IMMap:
+        var size int64 = 48
+        for k, e := range d {
+            size += memoryOverheadEntry + estimateValueSize(k) + estimateValueSize(e)
+        }
+        return size
+    case map[string]interface{}:
+        var size int64 = 48
+        for k, e := range d {
+            size += memoryOverheadEntry + estimateValueSize(k) + estimateValueSize(e)
+        }
+        return size
+    case set.Set:
+        var size int64 = memoryOverheadSet
+        d.Each(func(e interface{}) bool {
+            size += memoryOverheadEntry + estimateValueSize(e)
+            return false
+        })
+        return size
+    }
+    return memoryOverheadInterface
+}
+
+func (r *LocalFastRedis) dbSize() int {
+    c := 0
+    r.dataPool.Range(func(key, value interface{}) bool {
+        d, ok := value.(IPoolData)
+        if ok && d.CheckAlive() {
+            c += 1
+        }
+        return true
+    })
+    return c
+}
+
+func (r *LocalFastRedis) info(section string) string {
+    section = strings.ToLower(section)
+    all := section == "" || section == "all" || section == "default" || section == "everything"
+
+    var b strings.Builder
+    if all || section == "keyspace" {
+        r.infoKeyspace(&b)
+    }
+    if all || section == "memory" {
+        r.infoMemory(&b)
+    }
+    if all || section == "stats" {
+        r.infoStats(&b)
+    }
+    if (all || section == "replication") && r.replication != nil {
+        b.WriteString("# Replication\r\n")
+        b.WriteString(r.replication.info())
+        b.WriteString("\r\n")
+    }
+    if section == "all" || section == "everything" || section == "commandstats" {
+        r.infoCommandStats(&b)
+    }
+    return b.String()
+}
+
+func (r *LocalFastRedis) infoKeyspace(b *strings.Builder) {
+    var keys, expires int
+    types := make(map[RedisDataType]int)
+    r.dataPool.Range(func(key, value interface{}) bool {
+        d, ok := value.(IPoolData)
+        if !ok || !d.CheckAlive() {
+            return true
+        }
+        keys += 1
+        types[d.GetDataType()] += 1
+        if poolDataExpire(d) > 0 {
+            expires += 1
+        }
+        return true
+    })
+    b.WriteString("# Keyspace\r\n")
+    if keys > 0 {
+        fmt.Fprintf(b, "db0:keys=%d,expires=%d,strings=%d,hashes=%d,lists=%d,sets=%d\r\n",
+            keys, expires, types[REDIS_TYPE_STANDARD], types[REDIS_TYPE_MAP], types[REDIS_TYPE_LIST], types[REDIS_TYPE_SET])
+    }
+    b.WriteString("\r\n")
+}
+
+func (r *LocalFastRedis) infoMemory(b *strings.Builder) {
+    var used int64
+    r.dataPool.Range(func(key, value interface{}) bool {
+        d, ok := value.(IPoolData)
+        if ok {
+            used += memoryOverheadEntry + estimateValueSize(key) + d.GetMemoryUsage()
+        }
+        return true
+    })
+    b.WriteString("# Memory\r\n")
+    fmt.Fprintf(b, "used_memory:%d\r\n", used)
+    fmt.Fprintf(b, "used_memory_human:%s\r\n", humanBytes(used))
+    b.WriteString("\r\n")
+}
+
+func (r *LocalFastRedis) infoStats(b *strings.Builder) {
+    s := r.stats
+    b.WriteString("# Stats\r\n")
+    fmt.Fprintf(b, "uptime_in_seconds:%d\r\n", int64(time.Since(s.started).Seconds()))
+    fmt.Fprintf(b, "total_commands_processed:%d\r\n", atomic.LoadInt64(&s.commands))
+    fmt.Fprintf(b, "expired_keys:%d\r\n", atomic.LoadInt64(&s.expired))
+    //本地实例没有容量上限, 不会淘汰数据; 近端缓存的淘汰计数见 NearCacheRedis 的 INFO
+    fmt.Fprintf(b, "evicted_keys:%d\r\n", atomic.LoadInt64(&s.evicted))
+    fmt.Fprintf(b, "keyspace_hits:%d\r\n", atomic.LoadInt64(&s.hits))
+    fmt.Fprintf(b, "keyspace_misses:%d\r\n", atomic.LoadInt64(&s.misses))
+    b.WriteString("\r\n")
+}
+
+func (r *LocalFastRedis) infoCommandStats(b *strings.Builder) {
+    s := r.stats
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    cmds := make([]string, 0, len(s.cmdStats))
+    for cmd := range s.cmdStats {
+        cmds = append(cmds, cmd)
+    }
+    sort.Strings(cmds)
+    b.WriteString("# Commandstats\r\n")
+    for _, cmd := range cmds {
+        c := s.cmdStats[cmd]
+        perCall := float64(0)
+        if c.calls > 0 {
+            perCall = float64(c.usec) / float64(c.calls)
+        }
+        fmt.Fprintf(b, "cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f\r\n", cmd, c.calls, c.usec, perCall)
+    }
+    b.WriteString("\r\n")
+}
+
+func humanBytes(n int64) string {
+    const unit = 1024
+    if n < unit {
+        return fmt.Sprintf("%dB", n)
+    }
+    div, exp := int64(unit), 0
+    for v := n / unit; v >= unit; v /= unit {
+        div *= unit
+        exp++
+    }
+    return fmt.Sprintf("%.2f%c", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -1,5 +1,11 @@
 package main
 
+type MySQLRetryConfig struct {
+    Attempts int `json:"attempts,omitempty"`
+    BaseDelay string `json:"base,omitempty"`
+    MaxDelay string `json:"max,omitempty"`
+}
+
 type MySQLConfig struct {
     Addr string `json:"addr"`
     DBName string `json:"dbName"`
@@ -9,15 +15,105 @@ type MySQLConfig struct {
     IdleTime string `json:"idle"`
     LifeTime string `json:"life"`
     Encoding string `json:"encoding,omitempty"`
+    TypedColumns bool `json:"typedColumns,omitempty"`
+    ParseTime bool `json:"parseTime,omitempty"`
+    Loc string `json:"loc,omitempty"`
+    TimeFormat string `json:"timeFormat,omitempty"`
+    Null string `json:"null,omitempty"`
+    StreamChunkRows int `json:"streamChunkRows,omitempty"`
+    StreamChunkBytes int `json:"streamChunkBytes,omitempty"`
+    StreamIdle string `json:"streamIdle,omitempty"`
+    MaxPageSize int `json:"maxPageSize,omitempty"`
+    PageSecret string `json:"pageSecret,omitempty"`
+    TxIdle string `json:"txIdle,omitempty"`
+    TxLimit int `json:"txLimit,omitempty"`
+    Retry MySQLRetryConfig `json:"retry,omitempty"`
+    StmtCacheSize int `json:"stmtCache,omitempty"`
+    Timeout string `json:"timeout,omitempty"`
+}
+
+type NearCacheConfig struct {
+    Enable bool `json:"enable"`
+    Size int `json:"size,omitempty"`
+    MaxStale string `json:"maxStale,omitempty"`
+}
+
+type ReplicationConfig struct {
+    Role string `json:"role"`
+    Listen string `json:"listen,omitempty"`
+    PrimaryAddr string `json:"primary,omitempty"`
+    BacklogSize int `json:"backlog,omitempty"`
+}
+
+type SentinelConfig struct {
+    Addrs []string `json:"addrs"`
+    MasterName string `json:"masterName"`
+    Pwd string `json:"pwd,omitempty"`
+    ReadReplicas bool `json:"readReplicas,omitempty"`
+    TLS RedisTLSConfig `json:"tls,omitempty"`
+}
+
+type BreakerConfig struct {
+    Enable bool `json:"enable"`
+    Failures int `json:"failures,omitempty"`
+    OpenTime string `json:"openTime,omitempty"`
+    Probes int `json:"probes,omitempty"`
+    Fallback bool `json:"fallback,omitempty"`
+    Reconcile string `json:"reconcile,omitempty"`
+    JournalSize int `json:"journal,omitempty"`
+}
+
+type ClientPolicyConfig struct {
+    Allow []string `json:"allow,omitempty"`
+    Deny []string `json:"deny,omitempty"`
+    MaxArgs map[string]int `json:"maxArgs,omitempty"`
+}
+
+type PolicyConfig struct {
+    Allow []string `json:"allow,omitempty"`
+    Deny []string `json:"deny,omitempty"`
+    MaxArgs map[string]int `json:"maxArgs,omitempty"`
+    Clients map[string]ClientPolicyConfig `json:"clients,omitempty"`
+}
+
+type NamespaceConfig struct {
+    Separator string `json:"separator,omitempty"`
+    Clients map[string]string `json:"clients,omitempty"`
+}
+
+type RedisTLSConfig struct {
+    Enable bool `json:"enable"`
+    CAFile string `json:"ca,omitempty"`
+    CertFile string `json:"cert,omitempty"`
+    KeyFile string `json:"key,omitempty"`
+    ServerName string `json:"serverName,omitempty"`
+    SkipVerify bool `json:"skipVerify,omitempty"`
 }
 
 type RedisConfig struct {
     Addr string `json:"addr"`
+    Replicas []string `json:"replicas,omitempty"`
+    Nodes []string `json:"nodes,omitempty"`
+    Cluster bool `json:"cluster,omitempty"`
+    Sentinel SentinelConfig `json:"sentinel,omitempty"`
+    Username string `json:"username,omitempty"`
     Pwd string `json:"pwd,omitempty"`
+    TLS RedisTLSConfig `json:"tls,omitempty"`
     Idle int `json:"maxIdle"`
     Active int `json:"maxActive"`
     IdleTime string `json:"idle"`
     LifeTime string `json:"life"`
+    ConnectTimeout string `json:"connectTimeout,omitempty"`
+    ReadTimeout string `json:"readTimeout,omitempty"`
+    ValueCodec bool `json:"valueCodec,omitempty"`
+    CanonicalReplies bool `json:"canonicalReplies,omitempty"`
+    ForkLimit int `json:"forkLimit,omitempty"`
+    ForkIdleTime string `json:"forkIdle,omitempty"`
+    NearCache NearCacheConfig `json:"nearCache,omitempty"`
+    Replication ReplicationConfig `json:"replication,omitempty"`
+    Breaker BreakerConfig `json:"breaker,omitempty"`
+    Policy PolicyConfig `json:"policy,omitempty"`
+    Namespace NamespaceConfig `json:"namespace,omitempty"`
 }
 
 type Config struct {
@@ -1,16 +1,149 @@
 package main
 
 import (
+    "context"
     "fmt"
+    "time"
 
     "github.com/packing/clove/codecs"
     "github.com/packing/clove/messages"
+    "github.com/packing/clove/nnet"
     "github.com/packing/clove/utils"
 )
 
 type StorageMessageObject struct {
 }
 
+const (
+    tcpOwnerPrefix  = "tcp:"
+    unixOwnerPrefix = "unix:"
+)
+
+//storage 扩展的协议字段和消息类型, 取值避开 clove 已占用的部分
+const (
+    ProtocolKeyForcePrimary = 0x92
+    ProtocolKeyNamespace    = 0x93
+    ProtocolKeyChannels     = 0x94
+    ProtocolKeyChannel      = 0x95
+    //订阅请求中表示按模式订阅, 推送的消息中为匹配到的模式
+    ProtocolKeyPattern      = 0x96
+    //OnQuery 的结果格式, 取值见 MySQLResultMaps 等
+    ProtocolKeyResultFormat = 0x97
+    ProtocolKeyStreamId     = 0x98
+    ProtocolKeySeq          = 0x99
+    //流式查询的结束标记
+    ProtocolKeyEnd          = 0x9a
+    //流式查询每块的最大行数
+    ProtocolKeyChunkRows    = 0x9b
+    //流式查询的初始额度, 或 ProtocolTypeDBStreamNext 中追加的额度
+    ProtocolKeyCredits      = 0x9c
+    ProtocolKeyError        = 0x9d
+    //分页查询的排序列, 多个列以逗号分隔
+    ProtocolKeyOrderKey     = 0x9e
+    ProtocolKeyPageSize     = 0x9f
+    ProtocolKeyPageToken    = 0xa0
+    ProtocolKeyDescending   = 0xa1
+    //交互式事务的id, 由 ProtocolTypeDBTxBegin 的应答返回
+    ProtocolKeyTxId         = 0xa2
+    //事务隔离级别, 如 "READ COMMITTED"
+    ProtocolKeyIsolation    = 0xa3
+    ProtocolKeyReadOnly     = 0xa4
+    //应答中语句因死锁或锁等待超时而重试的次数, 没有重试时不出现
+    ProtocolKeyRetries      = 0xa5
+    //单个请求的超时时长(毫秒), 不指定时使用mysql配置节中的 timeout
+    ProtocolKeyTimeout      = 0xa6
+    //要取消的请求的序号
+    ProtocolKeyRequestId    = 0xa7
+    //OnTransaction 返回各语句的结果和失败原因, 不指定时与旧版一样只返回是否成功
+    ProtocolKeyTxDetail     = 0xa8
+
+    ProtocolTypeDBQueryStream  = 0x1a
+    ProtocolTypeDBStreamNext   = 0x1b
+    ProtocolTypeDBStreamCancel = 0x1c
+    //由storage主动推送的流式查询结果块
+    ProtocolTypeDBStreamChunk  = 0x1d
+    ProtocolTypeDBQueryPage    = 0x1e
+
+    ProtocolTypeDBTxBegin    = 0x29
+    ProtocolTypeDBTxExec     = 0x2a
+    ProtocolTypeDBTxQuery    = 0x2b
+    ProtocolTypeDBTxCommit   = 0x2c
+    ProtocolTypeDBTxRollback = 0x2d
+    ProtocolTypeDBCancel     = 0x2e
+
+    ProtocolTypeRedisSubscribe   = 0x26
+    ProtocolTypeRedisUnsubscribe = 0x27
+    //由storage主动推送的订阅消息
+    ProtocolTypeRedisMessage     = 0x28
+)
+
+//controllerOwner 以TCP会话标识客户端, 用于在连接断开时释放其占用的资源
+func controllerOwner(controller nnet.Controller) string {
+    return fmt.Sprintf("%s%d", tcpOwnerPrefix, controller.GetSessionID())
+}
+
+func messageOwner(msg *messages.Message) string {
+    if msg.GetUnixSource() != "" {
+        return unixOwnerPrefix + msg.GetUnixSource()
+    }
+    if msg.GetController() != nil {
+        return controllerOwner(msg.GetController())
+    }
+    return ""
+}
+
+//mysqlRequestContext 按请求中的超时时长创建 context, 并登记请求以便按序号取消
+func mysqlRequestContext(msg *messages.Message, body codecs.IMMap) (context.Context, func()) {
+    timeout := mysqlClient.timeout
+    ms := codecs.CreateMapReader(body).IntValueOf(ProtocolKeyTimeout, 0)
+    if ms > 0 {
+        timeout = time.Duration(ms) * time.Millisecond
+    }
+    return mysqlRequests.Start(messageOwner(msg), msg.GetSearial(), timeout)
+}
+
+func setRetries(srcData codecs.IMMap, retries int) {
+    if retries > 0 {
+        srcData[ProtocolKeyRetries] = retries
+    } else {
+        delete(srcData, ProtocolKeyRetries)
+    }
+}
+
+//pushTarget 由storage主动推送消息的目标客户端, 推送时沿用发起请求的协议头
+type pushTarget struct {
+    owner      string
+    unixAddr   string
+    controller nnet.Controller
+    header     codecs.IMMap
+}
+
+func createPushTarget(msg *messages.Message, srcData codecs.IMMap, msgType int) *pushTarget {
+    target := &pushTarget{owner: messageOwner(msg), unixAddr: msg.GetUnixSource(), controller: msg.GetController()}
+    target.header = make(codecs.IMMap)
+    for k, v := range srcData {
+        target.header[k] = v
+    }
+    delete(target.header, messages.ProtocolKeyBody)
+    delete(target.header, messages.ProtocolKeySerial)
+    delete(target.header, messages.ProtocolKeySync)
+    target.header[messages.ProtocolKeyType] = msgType
+    return target
+}
+
+func (target *pushTarget) push(body codecs.IMMap) {
+    data := make(codecs.IMMap)
+    for k, v := range target.header {
+        data[k] = v
+    }
+    data[messages.ProtocolKeyBody] = body
+    if target.unixAddr != "" {
+        unix.SendTo(target.unixAddr, data)
+    } else if target.controller != nil {
+        target.controller.Send(data)
+    }
+}
+
 func (receiver StorageMessageObject) OnQuery(msg *messages.Message) error {
     body := msg.GetBody()
     if body == nil {
@@ -28,7 +161,16 @@ func (receiver StorageMessageObject) OnQuery(msg *messages.Message) error {
     if sql == "" || !ok {
         return messages.ErrorDataNotIsMessageMap
     }
-    rows, err := mysqlClient.Query(sql, args...)
+    var rows interface{}
+    var err error
+    format := int(r.IntValueOf(ProtocolKeyResultFormat, MySQLResultMaps))
+    ctx, done := mysqlRequestContext(msg, body)
+    if format == MySQLResultMaps {
+        rows, err = mysqlClient.Query(ctx, sql, args...)
+    } else {
+        rows, err = mysqlClient.QueryAs(ctx, format, sql, args...)
+    }
+    done()
     if err == nil {
         srcData[messages.ProtocolKeyBody] = rows
     } else {
@@ -43,6 +185,146 @@ func (receiver StorageMessageObject) OnQuery(msg *messages.Message) error {
     return nil
 }
 
+func (receiver StorageMessageObject) OnQueryStream(msg *messages.Message) error {
+    body := msg.GetBody()
+    if body == nil {
+        return messages.ErrorDataNotIsMessageMap
+    }
+
+    srcData, ok := msg.GetSrcData().(codecs.IMMap)
+    if !ok {
+        return messages.ErrorDataNotIsMessageMap
+    }
+    r := codecs.CreateMapReader(body)
+    sql := r.StrValueOf(messages.ProtocolKeySQL, "")
+    iArgs := r.TryReadValue(messages.ProtocolKeyArgs)
+    args, ok := iArgs.(codecs.IMSlice)
+    if sql == "" || !ok {
+        return messages.ErrorDataNotIsMessageMap
+    }
+    format := int(r.IntValueOf(ProtocolKeyResultFormat, MySQLResultMaps))
+    chunkRows := int(r.IntValueOf(ProtocolKeyChunkRows, 0))
+    credits := int(r.IntValueOf(ProtocolKeyCredits, 1))
+    target := createPushTarget(msg, srcData, ProtocolTypeDBStreamChunk)
+    id, err := mysqlStreams.Start(target, format, chunkRows, credits, sql, args...)
+    if err == nil {
+        m := make(codecs.IMMap)
+        m[ProtocolKeyStreamId] = id
+        srcData[messages.ProtocolKeyBody] = m
+    } else {
+        srcData[messages.ProtocolKeyBody] = err.Error()
+    }
+
+    if msg.GetUnixSource() != "" {
+        unix.SendTo(msg.GetUnixSource(), srcData)
+    } else {
+        msg.GetController().Send(srcData)
+    }
+    if err == nil {
+        mysqlStreams.Run(id)
+    }
+    return nil
+}
+
+func (receiver StorageMessageObject) OnStreamNext(msg *messages.Message) error {
+    body := msg.GetBody()
+    if body == nil {
+        return messages.ErrorDataNotIsMessageMap
+    }
+    r := codecs.CreateMapReader(body)
+    id := r.UintValueOf(ProtocolKeyStreamId, 0)
+    if id == 0 {
+        return messages.ErrorDataNotIsMessageMap
+    }
+    //追加额度是高频操作, 只在出错时应答
+    err := mysqlStreams.Next(id, messageOwner(msg), int(r.IntValueOf(ProtocolKeyCredits, 1)))
+    if err == nil {
+        return nil
+    }
+    srcData, ok := msg.GetSrcData().(codecs.IMMap)
+    if !ok {
+        return messages.ErrorDataNotIsMessageMap
+    }
+    srcData[messages.ProtocolKeyBody] = err.Error()
+    if msg.GetUnixSource() != "" {
+        unix.SendTo(msg.GetUnixSource(), srcData)
+    } else {
+        msg.GetController().Send(srcData)
+    }
+    return nil
+}
+
+func (receiver StorageMessageObject) OnStreamCancel(msg *messages.Message) error {
+    body := msg.GetBody()
+    if body == nil {
+        return messages.ErrorDataNotIsMessageMap
+    }
+
+    srcData, ok := msg.GetSrcData().(codecs.IMMap)
+    if !ok {
+        return messages.ErrorDataNotIsMessageMap
+    }
+    r := codecs.CreateMapReader(body)
+    id := r.UintValueOf(ProtocolKeyStreamId, 0)
+    if id == 0 {
+        return messages.ErrorDataNotIsMessageMap
+    }
+    err := mysqlStreams.Cancel(id, messageOwner(msg))
+    if err == nil {
+        srcData[messages.ProtocolKeyBody] = true
+    } else {
+        srcData[messages.ProtocolKeyBody] = err.Error()
+    }
+    if msg.GetUnixSource() != "" {
+        unix.SendTo(msg.GetUnixSource(), srcData)
+    } else {
+        msg.GetController().Send(srcData)
+    }
+    return nil
+}
+
+func (receiver StorageMessageObject) OnQueryPage(msg *messages.Message) error {
+    body := msg.GetBody()
+    if body == nil {
+        return messages.ErrorDataNotIsMessageMap
+    }
+
+    srcData, ok := msg.GetSrcData().(codecs.IMMap)
+    if !ok {
+        return messages.ErrorDataNotIsMessageMap
+    }
+    r := codecs.CreateMapReader(body)
+    sql := r.StrValueOf(messages.ProtocolKeySQL, "")
+    orderKey := r.StrValueOf(ProtocolKeyOrderKey, "")
+    iArgs := r.TryReadValue(messages.ProtocolKeyArgs)
+    args, ok := iArgs.(codecs.IMSlice)
+    if sql == "" || orderKey == "" || !ok {
+        return messages.ErrorDataNotIsMessageMap
+    }
+    format := int(r.IntValueOf(ProtocolKeyResultFormat, MySQLResultMaps))
+    pageSize := int(r.IntValueOf(ProtocolKeyPageSize, 0))
+    token := r.StrValueOf(ProtocolKeyPageToken, "")
+    desc := r.BoolValueOf(ProtocolKeyDescending)
+    ctx, done := mysqlRequestContext(msg, body)
+    rows, next, err := mysqlClient.QueryPage(ctx, format, sql, args, orderKey, desc, pageSize, token)
+    done()
+    if err == nil {
+        m := make(codecs.IMMap)
+        m[messages.ProtocolKeyResult] = rows
+        m[ProtocolKeyPageToken] = next
+        srcData[messages.ProtocolKeyBody] = m
+    } else {
+        srcData[messages.ProtocolKeyBody] = err.Error()
+    }
+
+    if msg.GetUnixSource() != "" {
+        unix.SendTo(msg.GetUnixSource(), srcData)
+    } else {
+        msg.GetController().Send(srcData)
+    }
+    return nil
+}
+
 func (receiver StorageMessageObject) OnExec(msg *messages.Message) error {
     body := msg.GetBody()
     if body == nil {
@@ -60,7 +342,10 @@ func (receiver StorageMessageObject) OnExec(msg *messages.Message) error {
     if sql == "" || !ok {
         return messages.ErrorDataNotIsMessageMap
     }
-    ret, err := mysqlClient.QueryWithoutResult(sql, args...)
+    ctx, done := mysqlRequestContext(msg, body)
+    ret, retries, err := mysqlClient.QueryWithoutResult(ctx, sql, args...)
+    done()
+    setRetries(srcData, retries)
     if err == nil {
         srcData[messages.ProtocolKeyBody] = ret
     } else {
@@ -120,7 +405,121 @@ func (receiver StorageMessageObject) OnTransaction(msg *messages.Message) error
         params[i] = TxParam{sql:sql, args:arg, action: action}
     }
 
-    ret, err := mysqlClient.Transaction(params...)
+    format := int(r.IntValueOf(ProtocolKeyResultFormat, MySQLResultMaps))
+    opts, err := parseTxOptions(r.StrValueOf(ProtocolKeyIsolation, ""), r.BoolValueOf(ProtocolKeyReadOnly))
+    var results []TxResult
+    var failure *TxFailure
+    retries := 0
+    if err == nil {
+        ctx, done := mysqlRequestContext(msg, body)
+        results, failure, retries, err = mysqlClient.Transaction(ctx, opts, format, params...)
+        done()
+    }
+    setRetries(srcData, retries)
+    if err == nil {
+        if failure != nil {
+            utils.LogWarn("事务已回滚: %s", failure.Error())
+        }
+        if r.BoolValueOf(ProtocolKeyTxDetail) {
+            srcData[messages.ProtocolKeyBody] = txReply(results, failure)
+        } else {
+            srcData[messages.ProtocolKeyBody] = failure == nil
+        }
+    } else {
+        srcData[messages.ProtocolKeyBody] = err.Error()
+    }
+
+    if msg.GetUnixSource() != "" {
+        unix.SendTo(msg.GetUnixSource(), srcData)
+    } else {
+        msg.GetController().Send(srcData)
+    }
+    return nil
+}
+
+//OnDBCancel 按序号取消同一客户端正在执行的查询, 被取消的请求以 ErrorQueryCancelled 应答
+func (receiver StorageMessageObject) OnDBCancel(msg *messages.Message) error {
+    body := msg.GetBody()
+    if body == nil {
+        return messages.ErrorDataNotIsMessageMap
+    }
+
+    srcData, ok := msg.GetSrcData().(codecs.IMMap)
+    if !ok {
+        return messages.ErrorDataNotIsMessageMap
+    }
+    r := codecs.CreateMapReader(body)
+    serial := r.IntValueOf(ProtocolKeyRequestId, 0)
+    if serial == 0 {
+        return messages.ErrorDataNotIsMessageMap
+    }
+    err := mysqlRequests.Cancel(messageOwner(msg), serial)
+    if err == nil {
+        srcData[messages.ProtocolKeyBody] = true
+    } else {
+        srcData[messages.ProtocolKeyBody] = err.Error()
+    }
+
+    if msg.GetUnixSource() != "" {
+        unix.SendTo(msg.GetUnixSource(), srcData)
+    } else {
+        msg.GetController().Send(srcData)
+    }
+    return nil
+}
+
+func (receiver StorageMessageObject) OnTxBegin(msg *messages.Message) error {
+    srcData, ok := msg.GetSrcData().(codecs.IMMap)
+    if !ok {
+        return messages.ErrorDataNotIsMessageMap
+    }
+    isolation, readOnly := "", false
+    if body := msg.GetBody(); body != nil {
+        r := codecs.CreateMapReader(body)
+        isolation, readOnly = r.StrValueOf(ProtocolKeyIsolation, ""), r.BoolValueOf(ProtocolKeyReadOnly)
+    }
+    opts, err := parseTxOptions(isolation, readOnly)
+    var id uint64
+    if err == nil {
+        id, err = mysqlTransactions.Begin(messageOwner(msg), opts)
+    }
+    if err == nil {
+        m := make(codecs.IMMap)
+        m[ProtocolKeyTxId] = id
+        srcData[messages.ProtocolKeyBody] = m
+    } else {
+        srcData[messages.ProtocolKeyBody] = err.Error()
+    }
+
+    if msg.GetUnixSource() != "" {
+        unix.SendTo(msg.GetUnixSource(), srcData)
+    } else {
+        msg.GetController().Send(srcData)
+    }
+    return nil
+}
+
+func (receiver StorageMessageObject) OnTxExec(msg *messages.Message) error {
+    body := msg.GetBody()
+    if body == nil {
+        return messages.ErrorDataNotIsMessageMap
+    }
+
+    srcData, ok := msg.GetSrcData().(codecs.IMMap)
+    if !ok {
+        return messages.ErrorDataNotIsMessageMap
+    }
+    r := codecs.CreateMapReader(body)
+    id := r.UintValueOf(ProtocolKeyTxId, 0)
+    sql := r.StrValueOf(messages.ProtocolKeySQL, "")
+    iArgs := r.TryReadValue(messages.ProtocolKeyArgs)
+    args, ok := iArgs.(codecs.IMSlice)
+    if id == 0 || sql == "" || !ok {
+        return messages.ErrorDataNotIsMessageMap
+    }
+    ctx, done := mysqlRequestContext(msg, body)
+    ret, err := mysqlTransactions.Exec(ctx, id, messageOwner(msg), sql, args...)
+    done()
     if err == nil {
         srcData[messages.ProtocolKeyBody] = ret
     } else {
@@ -135,6 +534,85 @@ func (receiver StorageMessageObject) OnTransaction(msg *messages.Message) error
     return nil
 }
 
+func (receiver StorageMessageObject) OnTxQuery(msg *messages.Message) error {
+    body := msg.GetBody()
+    if body == nil {
+        return messages.ErrorDataNotIsMessageMap
+    }
+
+    srcData, ok := msg.GetSrcData().(codecs.IMMap)
+    if !ok {
+        return messages.ErrorDataNotIsMessageMap
+    }
+    r := codecs.CreateMapReader(body)
+    id := r.UintValueOf(ProtocolKeyTxId, 0)
+    sql := r.StrValueOf(messages.ProtocolKeySQL, "")
+    iArgs := r.TryReadValue(messages.ProtocolKeyArgs)
+    args, ok := iArgs.(codecs.IMSlice)
+    if id == 0 || sql == "" || !ok {
+        return messages.ErrorDataNotIsMessageMap
+    }
+    format := int(r.IntValueOf(ProtocolKeyResultFormat, MySQLResultMaps))
+    ctx, done := mysqlRequestContext(msg, body)
+    rows, err := mysqlTransactions.Query(ctx, id, messageOwner(msg), format, sql, args...)
+    done()
+    if err == nil {
+        srcData[messages.ProtocolKeyBody] = rows
+    } else {
+        srcData[messages.ProtocolKeyBody] = err.Error()
+    }
+
+    if msg.GetUnixSource() != "" {
+        unix.SendTo(msg.GetUnixSource(), srcData)
+    } else {
+        msg.GetController().Send(srcData)
+    }
+    return nil
+}
+
+func (receiver StorageMessageObject) onTxFinish(msg *messages.Message, commit bool) error {
+    body := msg.GetBody()
+    if body == nil {
+        return messages.ErrorDataNotIsMessageMap
+    }
+
+    srcData, ok := msg.GetSrcData().(codecs.IMMap)
+    if !ok {
+        return messages.ErrorDataNotIsMessageMap
+    }
+    r := codecs.CreateMapReader(body)
+    id := r.UintValueOf(ProtocolKeyTxId, 0)
+    if id == 0 {
+        return messages.ErrorDataNotIsMessageMap
+    }
+    var err error
+    if commit {
+        err = mysqlTransactions.Commit(id, messageOwner(msg))
+    } else {
+        err = mysqlTransactions.Rollback(id, messageOwner(msg))
+    }
+    if err == nil {
+        srcData[messages.ProtocolKeyBody] = true
+    } else {
+        srcData[messages.ProtocolKeyBody] = err.Error()
+    }
+
+    if msg.GetUnixSource() != "" {
+        unix.SendTo(msg.GetUnixSource(), srcData)
+    } else {
+        msg.GetController().Send(srcData)
+    }
+    return nil
+}
+
+func (receiver StorageMessageObject) OnTxCommit(msg *messages.Message) error {
+    return receiver.onTxFinish(msg, true)
+}
+
+func (receiver StorageMessageObject) OnTxRollback(msg *messages.Message) error {
+    return receiver.onTxFinish(msg, false)
+}
+
 func (receiver StorageMessageObject) OnRedisOpen(msg *messages.Message) error {
     //utils.LogError("OnRedisOpen")
     srcData, ok := msg.GetSrcData().(codecs.IMMap)
@@ -146,7 +624,7 @@ func (receiver StorageMessageObject) OnRedisOpen(msg *messages.Message) error {
     if key == 0 {
         return messages.ErrorDataNotIsMessageMap
     }
-    if !redisClient.OpenConn(key) {
+    if !redisClient.OpenConn(key, messageOwner(msg)) {
         srcData[messages.ProtocolKeyBody] = fmt.Errorf("cannot open the Redis connection").Error()
     } else {
         srcData[messages.ProtocolKeyBody] = true
@@ -171,6 +649,7 @@ func (receiver StorageMessageObject) OnRedisClose(msg *messages.Message) error {
         return messages.ErrorDataNotIsMessageMap
     }
     redisClient.CloseConn(key)
+    redisNamespaces.Close(key)
     srcData[messages.ProtocolKeyBody] = true
     if msg.GetUnixSource() != "" {
         unix.SendTo(msg.GetUnixSource(), srcData)
@@ -199,7 +678,23 @@ func (receiver StorageMessageObject) OnRedisDo(msg *messages.Message) error {
     if cmd == "" || !ok {
         return messages.ErrorDataNotIsMessageMap
     }
-    ret, e := redisClient.Do(cmd, args...)
+    var ret interface{}
+    client := messageClient(msg)
+    ns := redisNamespaces.Resolve(client, r.StrValueOf(ProtocolKeyNamespace, ""))
+    e := redisPolicy.Check(client, cmd, args)
+    if e == nil {
+        var nsArgs []interface{}
+        nsArgs, e = redisNamespaces.RewriteArgs(ns, cmd, args)
+        if e == nil {
+            replica, ok := redisClient.(IReplicaRedis)
+            if ok && !r.BoolValueOf(ProtocolKeyForcePrimary) && isRedisReadCommand(cmd) {
+                ret, e = replica.DoReplica(cmd, nsArgs...)
+            } else {
+                ret, e = redisClient.Do(cmd, nsArgs...)
+            }
+            ret = redisNamespaces.StripReply(ns, cmd, ret)
+        }
+    }
     if e != nil {
         srcData[messages.ProtocolKeyBody] = e.Error()
     } else {
@@ -238,7 +733,19 @@ func (receiver StorageMessageObject) OnRedisSend(msg *messages.Message) error {
     if cmd == "" || !ok {
         return messages.ErrorDataNotIsMessageMap
     }
-    e := redisClient.Send(key, cmd, args...)
+    client := messageClient(msg)
+    ns := redisNamespaces.Resolve(client, r.StrValueOf(ProtocolKeyNamespace, ""))
+    e := redisPolicy.Check(client, cmd, args)
+    if e == nil {
+        var nsArgs []interface{}
+        nsArgs, e = redisNamespaces.RewriteArgs(ns, cmd, args)
+        if e == nil {
+            e = redisClient.Send(key, messageOwner(msg), cmd, nsArgs...)
+        }
+        if e == nil {
+            redisNamespaces.Pipelined(key, messageOwner(msg), ns, cmd)
+        }
+    }
     if e != nil {
         srcData[messages.ProtocolKeyBody] = e.Error()
     } else {
@@ -262,7 +769,7 @@ func (receiver StorageMessageObject) OnRedisFlush(msg *messages.Message) error {
     if key == 0 {
         return messages.ErrorDataNotIsMessageMap
     }
-    e := redisClient.Flush(key)
+    e := redisClient.Flush(key, messageOwner(msg))
     if e != nil {
         srcData[messages.ProtocolKeyBody] = e.Error()
     } else {
@@ -286,7 +793,8 @@ func (receiver StorageMessageObject) OnRedisReceive(msg *messages.Message) error
     if key == 0 {
         return messages.ErrorDataNotIsMessageMap
     }
-    ret, e := redisClient.Receive(key)
+    ret, e := redisClient.Receive(key, messageOwner(msg))
+    ret = redisNamespaces.Received(key, ret)
     if e != nil {
         srcData[messages.ProtocolKeyBody] = e.Error()
     } else {
@@ -302,6 +810,89 @@ func (receiver StorageMessageObject) OnRedisReceive(msg *messages.Message) error
     return nil
 }
 
+func readChannels(body codecs.IMMap) ([]string, bool) {
+    r := codecs.CreateMapReader(body)
+    iChannels, ok := r.TryReadValue(ProtocolKeyChannels).(codecs.IMSlice)
+    if !ok || len(iChannels) == 0 {
+        return nil, false
+    }
+    channels := make([]string, len(iChannels))
+    for i, c := range iChannels {
+        channels[i] = redisArgString(c)
+    }
+    return channels, true
+}
+
+func (receiver StorageMessageObject) OnRedisSubscribe(msg *messages.Message) error {
+    body := msg.GetBody()
+    if body == nil {
+        return messages.ErrorDataNotIsMessageMap
+    }
+
+    srcData, ok := msg.GetSrcData().(codecs.IMMap)
+    if !ok {
+        return messages.ErrorDataNotIsMessageMap
+    }
+    channels, ok := readChannels(body)
+    if !ok {
+        return messages.ErrorDataNotIsMessageMap
+    }
+    reader := codecs.CreateMapReader(body)
+    pattern := reader.BoolValueOf(ProtocolKeyPattern)
+    client := messageClient(msg)
+    prefix := redisNamespaces.ChannelPrefix(redisNamespaces.Resolve(client, reader.StrValueOf(ProtocolKeyNamespace, "")))
+    cmd := "subscribe"
+    if pattern {
+        cmd = "psubscribe"
+    }
+    args := make([]interface{}, len(channels))
+    for i, c := range channels {
+        args[i] = c
+    }
+    e := redisPolicy.Check(client, cmd, args)
+    if e == nil {
+        e = redisSubscriptions.Subscribe(createPushTarget(msg, srcData, ProtocolTypeRedisMessage), prefix, channels, pattern)
+    }
+    if e != nil {
+        srcData[messages.ProtocolKeyBody] = e.Error()
+    } else {
+        srcData[messages.ProtocolKeyBody] = true
+    }
+    if msg.GetUnixSource() != "" {
+        unix.SendTo(msg.GetUnixSource(), srcData)
+    } else {
+        msg.GetController().Send(srcData)
+    }
+    return nil
+}
+
+func (receiver StorageMessageObject) OnRedisUnsubscribe(msg *messages.Message) error {
+    body := msg.GetBody()
+    if body == nil {
+        return messages.ErrorDataNotIsMessageMap
+    }
+
+    srcData, ok := msg.GetSrcData().(codecs.IMMap)
+    if !ok {
+        return messages.ErrorDataNotIsMessageMap
+    }
+    channels, ok := readChannels(body)
+    if !ok {
+        return messages.ErrorDataNotIsMessageMap
+    }
+    reader := codecs.CreateMapReader(body)
+    pattern := reader.BoolValueOf(ProtocolKeyPattern)
+    prefix := redisNamespaces.ChannelPrefix(redisNamespaces.Resolve(messageClient(msg), reader.StrValueOf(ProtocolKeyNamespace, "")))
+    redisSubscriptions.Unsubscribe(messageOwner(msg), prefix, channels, pattern)
+    srcData[messages.ProtocolKeyBody] = true
+    if msg.GetUnixSource() != "" {
+        unix.SendTo(msg.GetUnixSource(), srcData)
+    } else {
+        msg.GetController().Send(srcData)
+    }
+    return nil
+}
+
 func (receiver StorageMessageObject) OnInitLock(msg *messages.Message) error {
     srcData, ok := msg.GetSrcData().(codecs.IMMap)
     if !ok {
@@ -407,6 +998,16 @@ func (receiver StorageMessageObject) GetMappedTypes() (map[int]messages.MessageP
     msgMap[messages.ProtocolTypeDBQuery] = receiver.OnQuery
     msgMap[messages.ProtocolTypeDBExec] = receiver.OnExec
     msgMap[messages.ProtocolTypeDBTransaction] = receiver.OnTransaction
+    msgMap[ProtocolTypeDBQueryStream] = receiver.OnQueryStream
+    msgMap[ProtocolTypeDBStreamNext] = receiver.OnStreamNext
+    msgMap[ProtocolTypeDBStreamCancel] = receiver.OnStreamCancel
+    msgMap[ProtocolTypeDBQueryPage] = receiver.OnQueryPage
+    msgMap[ProtocolTypeDBTxBegin] = receiver.OnTxBegin
+    msgMap[ProtocolTypeDBTxExec] = receiver.OnTxExec
+    msgMap[ProtocolTypeDBTxQuery] = receiver.OnTxQuery
+    msgMap[ProtocolTypeDBTxCommit] = receiver.OnTxCommit
+    msgMap[ProtocolTypeDBTxRollback] = receiver.OnTxRollback
+    msgMap[ProtocolTypeDBCancel] = receiver.OnDBCancel
     msgMap[messages.ProtocolTypeLockKey] = receiver.OnLockKey
     msgMap[messages.ProtocolTypeUnLockKey] = receiver.OnUnLockKey
     msgMap[messages.ProtocolTypeInitLockKey] = receiver.OnInitLock
@@ -417,5 +1018,7 @@ func (receiver StorageMessageObject) GetMappedTypes() (map[int]messages.MessageP
     msgMap[messages.ProtocolTypeRedisSend] = receiver.OnRedisSend
     msgMap[messages.ProtocolTypeRedisFlush] = receiver.OnRedisFlush
     msgMap[messages.ProtocolTypeRedisReceive] = receiver.OnRedisReceive
+    msgMap[ProtocolTypeRedisSubscribe] = receiver.OnRedisSubscribe
+    msgMap[ProtocolTypeRedisUnsubscribe] = receiver.OnRedisUnsubscribe
     return msgMap
 }
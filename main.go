@@ -2,6 +2,7 @@ package main
 
 import (
     "encoding/json"
+    "expvar"
     "flag"
     "fmt"
     "io/ioutil"
@@ -36,7 +37,13 @@ var (
 
     keyLock *KeyLock
     mysqlClient *MySQL
+    mysqlStreams *MySQLStreams
+    mysqlTransactions *MySQLTransactions
+    mysqlRequests *MySQLRequests
     redisClient IRedis
+    redisPolicy *CommandPolicy
+    redisNamespaces *KeyNamespaces
+    redisSubscriptions *RedisSubscriptions
 )
 
 func usage() {
@@ -73,20 +80,20 @@ func main() {
 
     confContent, err := ioutil.ReadFile(configfile)
     if err != nil {
-        utils.LogError("!!!读取配置文件 %s 失败", configfile, err)
+        utils.LogError("!!!读取配置文件 %s 失败: %v", configfile, err)
         return
     }
 
     confString, err := GoJsoner.Discard(string(confContent))
     if err != nil {
-        utils.LogError("!!!读取配置文件 %s 失败", configfile, err)
+        utils.LogError("!!!读取配置文件 %s 失败: %v", configfile, err)
         return
     }
 
     globalConfig := Config{}
     err = json.Unmarshal([]byte(confString), &globalConfig)
     if err != nil {
-        utils.LogError("!!!读取配置文件 %s 失败", configfile, err)
+        utils.LogError("!!!读取配置文件 %s 失败: %v", configfile, err)
         return
     }
 
@@ -146,20 +153,42 @@ func main() {
     if err == nil || !os.IsNotExist(err) {
         err = os.Remove(globalConfig.UnixAddress)
         if err != nil {
-            utils.LogError("无法删除unix管道旧文件", err)
+            utils.LogError("无法删除unix管道旧文件: %v", err)
         }
     }
 
     keyLock = CreateKeyLock(globalConfig.LockLifeTime)
     mysqlClient = new(MySQL)
     mysqlClient.InitPool(globalConfig.MySQL)
+    expvar.Publish("mysql", expvar.Func(mysqlClient.Metrics))
+    mysqlStreams = CreateMySQLStreams(globalConfig.MySQL)
+    mysqlTransactions = CreateMySQLTransactions(globalConfig.MySQL)
+    mysqlRequests = CreateMySQLRequests()
 
-    if !globalConfig.LocalRedisInstance {
-        redisClient = new(Redis)
-    } else {
+    if globalConfig.LocalRedisInstance {
         redisClient = new(LocalFastRedis)
+    } else if globalConfig.Redis.Cluster {
+        redisClient = new(ClusterRedis)
+    } else if globalConfig.Redis.Sentinel.MasterName != "" {
+        redisClient = new(SentinelRedis)
+    } else if len(globalConfig.Redis.Nodes) > 0 {
+        redisClient = new(ShardedRedis)
+    } else if globalConfig.Redis.NearCache.Enable {
+        redisClient = new(NearCacheRedis)
+    } else {
+        redisClient = new(Redis)
+    }
+    if !globalConfig.LocalRedisInstance && globalConfig.Redis.Breaker.Enable {
+        redisClient = &BreakerRedis{backend: redisClient}
+    }
+    if globalConfig.Redis.CanonicalReplies {
+        redisClient = &CanonicalRedis{backend: redisClient}
     }
     redisClient.InitPool(globalConfig.Redis)
+    redisPolicy = CreateCommandPolicy(globalConfig.Redis.Policy)
+    expvar.Publish("redisPolicy", expvar.Func(redisPolicy.Metrics))
+    redisNamespaces = CreateKeyNamespaces(globalConfig.Redis)
+    redisSubscriptions = CreateRedisSubscriptions()
 
     messages.GlobalDispatcher.MessageObjectMapped(messages.ProtocolSchemeS2S, messages.ProtocolTagStorage, StorageMessageObject{})
     messages.GlobalDispatcher.Dispatch()
@@ -169,7 +198,7 @@ func main() {
     unix.OnDataDecoded = messages.GlobalMessageQueue.Push
     err = unix.Bind(globalConfig.UnixAddress)
     if err != nil {
-        utils.LogError("!!! 无法创建unixsocket管道 => %s", globalConfig.UnixAddress, err)
+        utils.LogError("!!! 无法创建unixsocket管道 => %s: %v", globalConfig.UnixAddress, err)
         unix.Close()
         return
     } else {
@@ -182,9 +211,17 @@ func main() {
         utils.LogInfo("new client come. %s", controller.GetSource())
         return nil
     }
+    tcp.OnBye = func(controller nnet.Controller) error {
+        redisClient.CloseOwnerConns(controllerOwner(controller))
+        redisNamespaces.CloseOwner(controllerOwner(controller))
+        redisSubscriptions.CloseOwner(controllerOwner(controller))
+        mysqlStreams.CloseOwner(controllerOwner(controller))
+        mysqlTransactions.CloseOwner(controllerOwner(controller))
+        return nil
+    }
     err = tcp.Bind(globalConfig.TCPAddress, 0)
     if err != nil {
-        utils.LogError("!!! 无法在地址 %s 上开启监听", globalConfig.TCPAddress, err)
+        utils.LogError("!!! 无法在地址 %s 上开启监听: %v", globalConfig.TCPAddress, err)
         unix.Close()
         tcp.Close()
         return
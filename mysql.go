@@ -1,12 +1,19 @@
 package main
 
 import (
+    "context"
+    "crypto/rand"
     "database/sql"
     "fmt"
+    "net/url"
+    "strconv"
     "strings"
+    "sync/atomic"
     "time"
 
     _ "github.com/go-sql-driver/mysql"
+    "github.com/packing/clove/codecs"
+    "github.com/packing/clove/errors"
     "github.com/packing/clove/utils"
 )
 
@@ -14,16 +21,123 @@ const (
     TXActionNothing = iota
     TXActionInsert
     TXActionUpdate
+    //以查询执行并在结果中返回读到的行
+    TXActionQuery
+    //sql 为保存点名称. 保存点与同名的 TXActionRelease 之间的语句失败时只回滚到保存点,
+    //跳过其余语句后继续执行, 事务不会中止. 保存点必须严格嵌套并且都有对应的 TXActionRelease
+    TXActionSavepoint
+    TXActionRelease
 )
 
+var (
+    ErrorInvalidIsolation = errors.Errorf("unsupported transaction isolation level")
+)
+
+//parseTxOptions 解析事务的隔离级别和只读模式, 隔离级别为空时使用服务器默认值
+func parseTxOptions(isolation string, readOnly bool) (*sql.TxOptions, error) {
+    opts := &sql.TxOptions{ReadOnly: readOnly}
+    switch strings.ToUpper(strings.TrimSpace(isolation)) {
+    case "":
+        opts.Isolation = sql.LevelDefault
+    case "READ UNCOMMITTED":
+        opts.Isolation = sql.LevelReadUncommitted
+    case "READ COMMITTED":
+        opts.Isolation = sql.LevelReadCommitted
+    case "REPEATABLE READ":
+        opts.Isolation = sql.LevelRepeatableRead
+    case "SERIALIZABLE":
+        opts.Isolation = sql.LevelSerializable
+    default:
+        return nil, ErrorInvalidIsolation
+    }
+    return opts, nil
+}
+
 type TxParam struct {
     sql string
     action int
     args []interface{}
 }
 
+//TxResult 事务中单条语句的执行结果, 只有 TXActionQuery 的语句有 Rows.
+//保存点内的语句失败时 Failure 为失败原因, 同一保存点内随后被跳过的语句 Skipped 为true
+type TxResult struct {
+    LastInsertId int64
+    RowsAffected int64
+    Rows interface{}
+    Failure *TxFailure
+    Skipped bool
+}
+
+//事务失败时的检查项
+const (
+    TxGuardError  = "error"
+    TxGuardInsert = "insert"
+    TxGuardUpdate = "update"
+    TxGuardSavepoint = "savepoint"
+)
+
+//TxFailure 事务中第 Index 条语句(从0开始)未通过 Guard 检查, 事务已回滚
+type TxFailure struct {
+    Index int
+    Guard string
+    Reason string
+    err error
+}
+
+func (f *TxFailure) Error() string {
+    return fmt.Sprintf("statement %d failed the %s guard: %s", f.Index, f.Guard, f.Reason)
+}
+
+//事务应答中的字段
+const (
+    MySQLTxKeySuccess = 0x01
+    MySQLTxKeyResults = 0x02
+    MySQLTxKeyFailure = 0x03
+
+    MySQLTxKeyLastInsertId = 0x01
+    MySQLTxKeyRowsAffected = 0x02
+    MySQLTxKeyRows         = 0x03
+    MySQLTxKeyError        = 0x04
+    MySQLTxKeySkipped      = 0x05
+
+    MySQLTxKeyIndex  = 0x01
+    MySQLTxKeyGuard  = 0x02
+    MySQLTxKeyReason = 0x03
+)
+
+const (
+    MySQLNullNil   = "nil"
+    MySQLNullEmpty = "empty"
+    MySQLNullOmit  = "omit"
+
+    MySQLTimeUnix      = "unix"
+    MySQLTimeUnixMilli = "unixMilli"
+)
+
+//OnQuery 的结果格式, 默认每行一个以列名为键的map
+const (
+    MySQLResultMaps = iota
+    MySQLResultRows
+    MySQLResultColumns
+)
+
+//紧凑格式结果中的字段
+const (
+    MySQLResultKeyColumns = 0x01
+    MySQLResultKeyData    = 0x02
+)
+
 type MySQL struct {
     db *sql.DB
+    typed bool
+    nullMode string
+    timeFormat string
+    maxPageSize int
+    pageSecret []byte
+    retry mysqlRetry
+    stmts mysqlStmtCache
+    timeout time.Duration
 }
 
 func (mysql *MySQL) InitPool(config MySQLConfig) bool {
@@ -32,9 +146,45 @@ func (mysql *MySQL) InitPool(config MySQLConfig) bool {
         format = "%s:%s@tcp(%s)/%s?charset=%s"
     }
     dataSource := fmt.Sprintf(format, config.User, config.Pwd, config.Addr, config.DBName, config.Encoding)
+    if config.ParseTime {
+        dataSource += "&parseTime=true"
+        if config.Loc != "" {
+            dataSource += "&loc=" + url.QueryEscape(config.Loc)
+        }
+    }
+    mysql.typed = config.TypedColumns
+    mysql.nullMode = config.Null
+    if mysql.nullMode != MySQLNullEmpty && mysql.nullMode != MySQLNullOmit {
+        mysql.nullMode = MySQLNullNil
+    }
+    mysql.timeFormat = config.TimeFormat
+    if mysql.timeFormat == "" {
+        mysql.timeFormat = MySQLTimeUnix
+    }
+    mysql.maxPageSize = config.MaxPageSize
+    if mysql.maxPageSize <= 0 {
+        mysql.maxPageSize = 1000
+    }
+    mysql.pageSecret = []byte(config.PageSecret)
+    if len(mysql.pageSecret) == 0 {
+        //未配置密钥时使用随机密钥, 重启后之前的续页标记失效
+        mysql.pageSecret = make([]byte, 32)
+        rand.Read(mysql.pageSecret)
+        utils.LogWarn("mysql配置节中未设置分页密钥pageSecret, 续页标记在重启后失效")
+    }
+    mysql.retry.init(config.Retry)
+    mysql.stmts.init(config.StmtCacheSize)
+    if config.Timeout != "" {
+        timeout, err := time.ParseDuration(config.Timeout)
+        if err == nil {
+            mysql.timeout = timeout
+        } else {
+            utils.LogWarn("mysql配置节中查询超时时长timeout的配置值可能有误")
+        }
+    }
     db, err := sql.Open("mysql", dataSource)
     if err != nil {
-        utils.LogError("初始化mysql连接池失败", err)
+        utils.LogError("初始化mysql连接池失败: %v", err)
         return false
     }
 
@@ -63,14 +213,91 @@ func (mysql *MySQL) InitPool(config MySQLConfig) bool {
 }
 
 func (mysql *MySQL) ReadRows(rows *sql.Rows) ([] map[string] interface{}, error) {
+    results := make([]map[string] interface{}, 0)
+    cols, err := mysql.scanRows(rows, func(cols []string, row []interface{}) bool {
+        results = append(results, mysql.rowMap(cols, row))
+        return true
+    })
+    if cols == nil {
+        return [] map[string] interface{}{}, err
+    }
+    return results, err
+}
+
+func (mysql *MySQL) rowMap(cols []string, row []interface{}) map[string] interface{} {
+    m := make(map[string] interface{})
+    for i, v := range row {
+        if v == nil && mysql.nullMode == MySQLNullOmit {
+            continue
+        }
+        m[cols[i]] = v
+    }
+    return m
+}
+
+//ReadRowsAs 按请求的结果格式读取, MySQLResultMaps 与 ReadRows 相同
+func (mysql *MySQL) ReadRowsAs(rows *sql.Rows, format int) (interface{}, error) {
+    if format != MySQLResultRows && format != MySQLResultColumns {
+        return mysql.ReadRows(rows)
+    }
+    data := make([][]interface{}, 0)
+    cols, err := mysql.scanRows(rows, func(cols []string, row []interface{}) bool {
+        data = append(data, row)
+        return true
+    })
+    return mysql.formatRows(format, cols, data), err
+}
+
+//formatRows 把已解码的行数据转换为指定的结果格式
+func (mysql *MySQL) formatRows(format int, cols []string, rows [][]interface{}) interface{} {
+    switch format {
+    case MySQLResultRows:
+        data := make([]interface{}, len(rows))
+        for i, row := range rows {
+            data[i] = row
+        }
+        return compactResult(cols, data)
+    case MySQLResultColumns:
+        data := make([]interface{}, len(cols))
+        for i := range cols {
+            column := make([]interface{}, len(rows))
+            for j, row := range rows {
+                column[j] = row[i]
+            }
+            data[i] = column
+        }
+        return compactResult(cols, data)
+    }
+    results := make([]map[string] interface{}, len(rows))
+    for i, row := range rows {
+        results[i] = mysql.rowMap(cols, row)
+    }
+    return results
+}
+
+//compactResult 紧凑格式的结果: 列名数组只出现一次, 数据为行数组或列数组
+func compactResult(cols []string, data []interface{}) codecs.IMMap {
+    header := make([]interface{}, len(cols))
+    for i, c := range cols {
+        header[i] = c
+    }
+    return codecs.IMMap{MySQLResultKeyColumns: header, MySQLResultKeyData: data}
+}
+
+//scanRows 逐行读取并按列类型解码, 每行调用一次 fn, 传入的行数据不会被复用, fn 返回false时停止读取.
+//无法读取列信息时返回的列名为nil
+func (mysql *MySQL) scanRows(rows *sql.Rows, fn func(cols []string, row []interface{}) bool) ([]string, error) {
     cols, err := rows.Columns()
+    var colTypes []*sql.ColumnType
+    if err == nil {
+        colTypes, err = rows.ColumnTypes()
+    }
     if err != nil {
         utils.LogError("============= MySQL ReadRows Error =============")
         utils.LogError(">>> Description: %s", err.Error())
         utils.LogError("================================================")
-        return [] map[string] interface{}{}, err
+        return nil, err
     }
-    results := make([]map[string] interface{}, 0)
     for rows.Next() {
         rowResult := make([]interface{}, len(cols))
         rowResultPtr := make([]interface{}, len(cols))
@@ -78,29 +305,82 @@ func (mysql *MySQL) ReadRows(rows *sql.Rows) ([] map[string] interface{}, error)
             rowResultPtr[i] = &rowResult[i]
         }
         err = rows.Scan(rowResultPtr...)
-        if err == nil {
-            m := make(map[string] interface{})
-            for i, col := range rowResult {
-                switch col.(type) {
-                case []byte:
-                    m[cols[i]] = string(col.([]byte))
-                default:
-                    m[cols[i]] = col
-                }
-            }
-            results = append(results, m)
-        } else {
+        if err != nil {
             utils.LogError("============= MySQL ReadRows Error =============")
             utils.LogError(">>> Description: %s", err.Error())
             utils.LogError("================================================")
-            break
+            return cols, err
+        }
+        for i, col := range rowResult {
+            rowResult[i] = mysql.decodeColumn(colTypes[i], col)
+            if rowResult[i] == nil && mysql.nullMode == MySQLNullEmpty {
+                rowResult[i] = ""
+            }
+        }
+        if !fn(cols, rowResult) {
+            return cols, nil
         }
     }
-    return results, err
+    return cols, rows.Err()
+}
+
+//decodeColumn 按列的数据库类型把驱动返回的值转换为 IMv2 能够直接表达的类型.
+//文本协议下所有值都是 []byte, 预处理语句的二进制协议下整数和浮点数已经是数值类型.
+//未配置 typedColumns 时保持旧的行为, []byte 一律转换为字符串
+func (mysql *MySQL) decodeColumn(colType *sql.ColumnType, v interface{}) interface{} {
+    switch d := v.(type) {
+    case nil:
+        return nil
+    case time.Time:
+        return mysql.formatTime(d)
+    case float32:
+        //二进制协议下 FLOAT 列为 float32, 与文本协议统一为 float64
+        return float64(d)
+    case []byte:
+        if !mysql.typed {
+            return string(d)
+        }
+        return decodeColumnBytes(colType.DatabaseTypeName(), d)
+    }
+    return v
+}
+
+func decodeColumnBytes(typeName string, b []byte) interface{} {
+    switch typeName {
+    case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "BIGINT", "YEAR":
+        n, err := strconv.ParseInt(string(b), 10, 64)
+        if err == nil {
+            return n
+        }
+        //BIGINT UNSIGNED 超出 int64 的部分
+        u, err := strconv.ParseUint(string(b), 10, 64)
+        if err == nil {
+            return u
+        }
+    case "FLOAT", "DOUBLE":
+        f, err := strconv.ParseFloat(string(b), 64)
+        if err == nil {
+            return f
+        }
+    case "BIT", "BINARY", "VARBINARY", "BLOB", "TINYBLOB", "MEDIUMBLOB", "LONGBLOB", "GEOMETRY":
+        return b
+    }
+    //DECIMAL 以字符串保留精度; 未开启 parseTime 时日期时间同样是字符串
+    return string(b)
+}
+
+func (mysql *MySQL) formatTime(t time.Time) interface{} {
+    switch mysql.timeFormat {
+    case MySQLTimeUnix:
+        return t.Unix()
+    case MySQLTimeUnixMilli:
+        return t.UnixNano() / int64(time.Millisecond)
+    }
+    return t.Format(mysql.timeFormat)
 }
 
-func (mysql *MySQL) Query(sql string, args ...interface{}) ([] map[string] interface{}, error) {
-    rows, err := mysql.db.Query(sql, args...)
+func (mysql *MySQL) Query(ctx context.Context, sql string, args ...interface{}) ([] map[string] interface{}, error) {
+    rows, err := mysql.dbQuery(ctx, sql, args...)
     defer func() {
         if rows != nil {
             rows.Close()
@@ -111,78 +391,314 @@ func (mysql *MySQL) Query(sql string, args ...interface{}) ([] map[string] inter
         utils.LogError("============= MySQL Query Error =============")
         utils.LogError(">>> Sql: %s", sql)
         if len(args) > 0 {
-            utils.LogError(">>> Args: %s", args)
+            utils.LogError(">>> Args: %v", args)
         }
         utils.LogError(">>> Description: %s", err.Error())
         utils.LogError("=============================================")
 
-        return make([] map[string] interface{}, 0), err
+        return make([] map[string] interface{}, 0), mysqlContextError(ctx, err)
     }
 
-    return mysql.ReadRows(rows)
+    results, err := mysql.ReadRows(rows)
+    return results, mysqlContextError(ctx, err)
 }
 
-func (mysql *MySQL) QueryWithoutResult(sql string, args ...interface{}) (int64, error) {
-    result, err := mysql.db.Exec(sql, args...)
+//OpenRows 执行查询并直接返回 sql.Rows, 由调用方负责关闭, 用于流式读取
+func (mysql *MySQL) OpenRows(ctx context.Context, sql string, args ...interface{}) (*sql.Rows, error) {
+    rows, err := mysql.dbQuery(ctx, sql, args...)
     if err != nil {
         utils.LogError("============= MySQL Query Error =============")
         utils.LogError(">>> Sql: %s", sql)
         if len(args) > 0 {
-            utils.LogError(">>> Args: ", sql)
+            utils.LogError(">>> Args: %v", args)
         }
         utils.LogError(">>> Description: %s", err.Error())
         utils.LogError("=============================================")
-        return 0, err
+        return nil, mysqlContextError(ctx, err)
     }
+    return rows, nil
+}
+
+//QueryAs 与 Query 相同, 结果按 format 指定的格式返回
+func (mysql *MySQL) QueryAs(ctx context.Context, format int, sql string, args ...interface{}) (interface{}, error) {
+    rows, err := mysql.dbQuery(ctx, sql, args...)
+    defer func() {
+        if rows != nil {
+            rows.Close()
+        }
+    }()
+
+    if err != nil {
+        utils.LogError("============= MySQL Query Error =============")
+        utils.LogError(">>> Sql: %s", sql)
+        if len(args) > 0 {
+            utils.LogError(">>> Args: %v", args)
+        }
+        utils.LogError(">>> Description: %s", err.Error())
+        utils.LogError("=============================================")
+        return nil, mysqlContextError(ctx, err)
+    }
+
+    results, err := mysql.ReadRowsAs(rows, format)
+    return results, mysqlContextError(ctx, err)
+}
+
+//QueryWithoutResult 执行语句, 遇到死锁或锁等待超时时按配置重试, 同时返回重试的次数
+func (mysql *MySQL) QueryWithoutResult(ctx context.Context, sql string, args ...interface{}) (int64, int, error) {
+    var ret int64
+    retries, err := mysql.retry.do(ctx, func() error {
+        result, err := mysql.dbExec(ctx, sql, args...)
+        if err != nil {
+            return err
+        }
+        ret = execResult(result)
+        return nil
+    })
+    if err != nil {
+        utils.LogError("============= MySQL Query Error =============")
+        utils.LogError(">>> Sql: %s", sql)
+        if len(args) > 0 {
+            utils.LogError(">>> Args: %v", args)
+        }
+        utils.LogError(">>> Description: %s", err.Error())
+        utils.LogError("=============================================")
+        return 0, retries, mysqlContextError(ctx, err)
+    }
+    return ret, retries, nil
+}
+
+//Metrics 返回MySQL相关的计数
+func (mysql *MySQL) Metrics() interface{} {
+    return map[string]int64{
+        "retries":          atomic.LoadInt64(&mysql.retry.retries),
+        "retried":          atomic.LoadInt64(&mysql.retry.retried),
+        "retry_exhausted":  atomic.LoadInt64(&mysql.retry.exhausted),
+        "stmt_hits":        atomic.LoadInt64(&mysql.stmts.hits),
+        "stmt_misses":      atomic.LoadInt64(&mysql.stmts.misses),
+        "stmt_evictions":   atomic.LoadInt64(&mysql.stmts.evictions),
+        "stmt_invalidated": atomic.LoadInt64(&mysql.stmts.invalidated),
+    }
+}
 
+//execResult 插入语句返回新的自增id, 其他语句返回影响的行数
+func execResult(result sql.Result) int64 {
     lastId, errId := result.LastInsertId()
     effectRows, errRow := result.RowsAffected()
 
     if errId == nil && lastId > 0 {
-        return lastId, nil
+        return lastId
     }
 
     if errRow == nil {
-        return effectRows, nil
+        return effectRows
     }
-    return 0, nil
+    return 0
 }
 
-func (mysql *MySQL) Transaction(params ...TxParam) (bool, error) {
-    tx, err := mysql.db.Begin()
+//Transaction 依次执行各条语句, 任意一条出错或未通过检查时回滚并通过 TxFailure 说明原因.
+//处于保存点内的语句失败时只回滚到保存点. 返回已执行语句的结果, 失败时同样返回失败之前的结果;
+//error 只表示事务本身无法开始或提交. 因死锁或锁等待超时失败时整个事务按配置重试, 同时返回重试的次数
+func (mysql *MySQL) Transaction(ctx context.Context, opts *sql.TxOptions, format int, params ...TxParam) ([]TxResult, *TxFailure, int, error) {
+    failure := checkSavepoints(params)
+    if failure != nil {
+        return nil, failure, 0, nil
+    }
+    var results []TxResult
+    retries, err := mysql.retry.do(ctx, func() error {
+        var err error
+        results, failure, err = mysql.transaction(ctx, opts, format, params)
+        if err == nil && failure != nil && isRetryableError(failure.err) {
+            return failure.err
+        }
+        return err
+    })
+    if (err != nil || failure != nil) && ctx.Err() != nil {
+        //超时或取消导致的失败不作为语句本身的失败返回; 已经提交成功的事务不受之后到期的超时影响
+        return results, nil, retries, mysqlContextError(ctx, ctx.Err())
+    }
+    if failure != nil && err == failure.err {
+        err = nil
+    }
+    return results, failure, retries, err
+}
+
+func (mysql *MySQL) transaction(ctx context.Context, opts *sql.TxOptions, format int, params []TxParam) ([]TxResult, *TxFailure, error) {
+    tx, err := mysql.db.BeginTx(ctx, opts)
     if err != nil {
         utils.LogError("============= MySQL Query Error =============")
-        utils.LogError(">>> Params: ", params)
+        utils.LogError(">>> Params: %v", params)
         utils.LogError(">>> Description: %s", err.Error())
         utils.LogError("=============================================")
-        return false, err
+        return nil, nil, err
     }
 
-    for _, p := range params {
-        r, err := tx.Exec(p.sql, p.args...)
-        if err != nil {
+    results := make([]TxResult, 0, len(params))
+    savepoints := make([]string, 0)
+    for i := 0; i < len(params); i++ {
+        p := params[i]
+        var result TxResult
+        var failure *TxFailure
+        switch p.action {
+        case TXActionSavepoint:
+            failure = txSavepoint(ctx, tx, "SAVEPOINT", p.sql)
+            if failure == nil {
+                savepoints = append(savepoints, p.sql)
+            }
+        case TXActionRelease:
+            n := lastIndexOf(savepoints, p.sql)
+            if n < 0 {
+                failure = &TxFailure{Guard: TxGuardSavepoint, Reason: "no such savepoint " + p.sql}
+                break
+            }
+            failure = txSavepoint(ctx, tx, "RELEASE SAVEPOINT", p.sql)
+            savepoints = savepoints[:n]
+        default:
+            result, failure = mysql.txStatement(ctx, tx, format, p)
+        }
+        if failure == nil {
+            results = append(results, result)
+            continue
+        }
+
+        failure.Index = i
+        //死锁时整个事务已被回滚, 保存点也随之失效
+        if len(savepoints) == 0 || p.action == TXActionSavepoint || p.action == TXActionRelease || isRetryableError(failure.err) {
             tx.Rollback()
-            return false, err
+            return results, failure, nil
         }
-        switch p.action {
-        case TXActionInsert:
-            newId, err := r.LastInsertId()
-            if err != nil || newId <= 0 {
+
+        //回滚到最近的保存点, 跳过到与之对应的 TXActionRelease 为止
+        name := savepoints[len(savepoints)-1]
+        savepoints = savepoints[:len(savepoints)-1]
+        rollbackFailure := txSavepoint(ctx, tx, "ROLLBACK TO SAVEPOINT", name)
+        if rollbackFailure != nil {
+            tx.Rollback()
+            rollbackFailure.Index = i
+            return results, rollbackFailure, nil
+        }
+        utils.LogInfo("事务回滚到保存点 %s: %s", name, failure.Error())
+        result.Failure = failure
+        results = append(results, result)
+        for i+1 < len(params) && !(params[i+1].action == TXActionRelease && params[i+1].sql == name) {
+            i += 1
+            results = append(results, TxResult{Skipped: true})
+        }
+        if i+1 < len(params) {
+            i += 1
+            failure = txSavepoint(ctx, tx, "RELEASE SAVEPOINT", name)
+            if failure != nil {
                 tx.Rollback()
-                return false, err
+                failure.Index = i
+                return results, failure, nil
             }
-        case TXActionUpdate:
-            effRow, err := r.RowsAffected()
-            if err != nil || effRow <= 0 {
-                tx.Rollback()
-                return false, err
+            results = append(results, TxResult{})
+        }
+    }
+
+    return results, nil, tx.Commit()
+}
+
+//checkSavepoints 在开始事务前检查保存点是否配对. 缺少 TXActionRelease 时失败的语句会跳过其余全部语句,
+//事务随后被当作成功提交, 因此不成对的保存点直接拒绝
+func checkSavepoints(params []TxParam) *TxFailure {
+    //未释放的保存点在 params 中的位置
+    open := make([]int, 0)
+    for i, p := range params {
+        switch p.action {
+        case TXActionSavepoint:
+            open = append(open, i)
+        case TXActionRelease:
+            if len(open) == 0 || params[open[len(open)-1]].sql != p.sql {
+                return &TxFailure{Index: i, Guard: TxGuardSavepoint, Reason: "release does not match the innermost savepoint " + p.sql}
             }
-        case TXActionNothing:
-            continue
+            open = open[:len(open)-1]
         }
     }
+    if len(open) > 0 {
+        i := open[len(open)-1]
+        return &TxFailure{Index: i, Guard: TxGuardSavepoint, Reason: "savepoint " + params[i].sql + " is never released"}
+    }
+    return nil
+}
 
-    tx.Commit()
+//txSavepoint 执行保存点语句, 名称只能是普通标识符
+func txSavepoint(ctx context.Context, tx *sql.Tx, stmt string, name string) *TxFailure {
+    if !sqlIdentPattern.MatchString(name) {
+        return &TxFailure{Guard: TxGuardSavepoint, Reason: "invalid savepoint name " + name}
+    }
+    _, err := tx.ExecContext(ctx, stmt + " `" + name + "`")
+    if err != nil {
+        return &TxFailure{Guard: TxGuardSavepoint, Reason: err.Error(), err: err}
+    }
+    return nil
+}
 
-    return true, nil
-}
\ No newline at end of file
+func lastIndexOf(list []string, s string) int {
+    for i := len(list) - 1; i >= 0; i-- {
+        if list[i] == s {
+            return i
+        }
+    }
+    return -1
+}
+
+func (mysql *MySQL) txStatement(ctx context.Context, tx *sql.Tx, format int, p TxParam) (TxResult, *TxFailure) {
+    var result TxResult
+    if p.action == TXActionQuery {
+        rows, done, err := mysql.txQuery(ctx, tx, p.sql, p.args...)
+        if err != nil {
+            return result, &TxFailure{Guard: TxGuardError, Reason: err.Error(), err: err}
+        }
+        result.Rows, err = mysql.ReadRowsAs(rows, format)
+        done()
+        if err != nil {
+            return result, &TxFailure{Guard: TxGuardError, Reason: err.Error(), err: err}
+        }
+        return result, nil
+    }
+
+    r, err := mysql.txExec(ctx, tx, p.sql, p.args...)
+    if err != nil {
+        return result, &TxFailure{Guard: TxGuardError, Reason: err.Error(), err: err}
+    }
+    result.LastInsertId, _ = r.LastInsertId()
+    result.RowsAffected, _ = r.RowsAffected()
+    switch p.action {
+    case TXActionInsert:
+        if result.LastInsertId <= 0 {
+            return result, &TxFailure{Guard: TxGuardInsert, Reason: "no auto-increment id was generated"}
+        }
+    case TXActionUpdate:
+        if result.RowsAffected <= 0 {
+            return result, &TxFailure{Guard: TxGuardUpdate, Reason: "no rows were affected"}
+        }
+    }
+    return result, nil
+}
+
+//txReply 事务的应答: 是否成功, 各语句的结果, 以及失败原因
+func txReply(results []TxResult, failure *TxFailure) codecs.IMMap {
+    items := make([]interface{}, len(results))
+    for i, r := range results {
+        item := codecs.IMMap{MySQLTxKeyLastInsertId: r.LastInsertId, MySQLTxKeyRowsAffected: r.RowsAffected}
+        if r.Rows != nil {
+            item[MySQLTxKeyRows] = r.Rows
+        }
+        if r.Failure != nil {
+            item[MySQLTxKeyError] = r.Failure.toMap()
+        }
+        if r.Skipped {
+            item[MySQLTxKeySkipped] = true
+        }
+        items[i] = item
+    }
+    reply := codecs.IMMap{MySQLTxKeySuccess: failure == nil, MySQLTxKeyResults: items}
+    if failure != nil {
+        reply[MySQLTxKeyFailure] = failure.toMap()
+    }
+    return reply
+}
+
+func (f *TxFailure) toMap() codecs.IMMap {
+    return codecs.IMMap{MySQLTxKeyIndex: f.Index, MySQLTxKeyGuard: f.Guard, MySQLTxKeyReason: f.Reason}
+}
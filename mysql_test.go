@@ -0,0 +1,49 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestCheckSavepoints(t *testing.T) {
+    sp := func(name string) TxParam { return TxParam{sql: name, action: TXActionSavepoint} }
+    rel := func(name string) TxParam { return TxParam{sql: name, action: TXActionRelease} }
+    stmt := TxParam{sql: "UPDATE t SET a = 1", action: TXActionNothing}
+    cases := []struct {
+        name   string
+        params []TxParam
+        ok     bool
+        index  int
+    }{
+        {"no savepoints", []TxParam{stmt, stmt}, true, 0},
+        {"empty", nil, true, 0},
+        {"single", []TxParam{stmt, sp("a"), stmt, rel("a"), stmt}, true, 0},
+        {"sequential", []TxParam{sp("a"), stmt, rel("a"), sp("b"), stmt, rel("b")}, true, 0},
+        {"nested", []TxParam{sp("a"), sp("b"), stmt, rel("b"), stmt, rel("a")}, true, 0},
+        {"reused name", []TxParam{sp("a"), rel("a"), sp("a"), rel("a")}, true, 0},
+        //缺少 Release 时失败的语句会跳过其余语句并被当作成功提交
+        {"missing release", []TxParam{stmt, sp("a"), stmt}, false, 1},
+        {"missing inner release", []TxParam{sp("a"), sp("b"), stmt, rel("a")}, false, 3},
+        {"missing outer release", []TxParam{sp("a"), sp("b"), rel("b"), stmt}, false, 0},
+        //Release 必须对应最内层的保存点
+        {"release without savepoint", []TxParam{stmt, rel("a")}, false, 1},
+        {"release of another name", []TxParam{sp("a"), rel("b")}, false, 1},
+        {"crossed", []TxParam{sp("a"), sp("b"), rel("a"), rel("b")}, false, 2},
+        {"double release", []TxParam{sp("a"), rel("a"), rel("a")}, false, 2},
+    }
+    for _, c := range cases {
+        failure := checkSavepoints(c.params)
+        if c.ok {
+            if failure != nil {
+                t.Errorf("%s: unexpected failure %v", c.name, failure)
+            }
+            continue
+        }
+        if failure == nil {
+            t.Errorf("%s: expected a failure", c.name)
+            continue
+        }
+        if failure.Index != c.index || failure.Guard != TxGuardSavepoint {
+            t.Errorf("%s: failure at %d (%s), want %d (%s)", c.name, failure.Index, failure.Guard, c.index, TxGuardSavepoint)
+        }
+    }
+}
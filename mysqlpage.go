@@ -0,0 +1,205 @@
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/base64"
+    "fmt"
+    "regexp"
+    "strings"
+
+    "github.com/packing/clove/codecs"
+    "github.com/packing/clove/errors"
+)
+
+var (
+    ErrorInvalidPageKey   = errors.Errorf("the order key must be one or more plain column names")
+    ErrorPageKeyNotFound  = errors.Errorf("the order key columns must be selected by the query")
+    ErrorInvalidPageToken = errors.Errorf("the page token is invalid or belongs to another query")
+    ErrorPageKeyType      = errors.Errorf("the order key columns must be integer, decimal or character columns")
+)
+
+//续页标记中签名的长度
+const pageTokenMacBytes = 16
+
+//可以作为排序列的列类型. 续页标记中保存的是解码后的值, 日期时间和浮点数解码后与原值比较的结果不一致
+var pageKeyTypes = map[string]bool{
+    "TINYINT":   true,
+    "SMALLINT":  true,
+    "MEDIUMINT": true,
+    "INT":       true,
+    "BIGINT":    true,
+    "DECIMAL":   true,
+    "CHAR":      true,
+    "VARCHAR":   true,
+    "TEXT":      true,
+}
+
+//sqlIdentPattern 允许直接拼接进SQL的标识符
+var sqlIdentPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+//parsePageKeys 解析逗号分隔的排序列, 多个列时按行构造器比较, 末尾的列应能保证唯一
+func parsePageKeys(orderKey string) ([]string, error) {
+    keys := strings.Split(orderKey, ",")
+    for i, key := range keys {
+        keys[i] = strings.TrimSpace(key)
+        if !sqlIdentPattern.MatchString(keys[i]) {
+            return nil, ErrorInvalidPageKey
+        }
+    }
+    return keys, nil
+}
+
+//pageTokenMac 以服务端密钥对查询、查询参数和排序列值签名, 客户端无法伪造或把续页标记用于其它查询
+func (mysql *MySQL) pageTokenMac(sql string, args []interface{}, keys []string, desc bool, payload []byte) []byte {
+    h := hmac.New(sha256.New, mysql.pageSecret)
+    h.Write([]byte(sql))
+    h.Write([]byte{0})
+    //参数来自 IMv2 解码, 编码结果自带长度, 不会与其后的内容混淆
+    var data codecs.IMData = codecs.IMSlice(args)
+    err, b := codecs.CodecIMv2.Encoder.Encode(&data)
+    if err != nil {
+        b = []byte(fmt.Sprint(args))
+    }
+    h.Write(b)
+    h.Write([]byte{0})
+    h.Write([]byte(strings.Join(keys, ",")))
+    if desc {
+        h.Write([]byte{1})
+    } else {
+        h.Write([]byte{0})
+    }
+    h.Write(payload)
+    return h.Sum(nil)[:pageTokenMacBytes]
+}
+
+//续页标记为 签名 + IMv2 编码的最后一行的排序列值, 对客户端不透明
+func (mysql *MySQL) encodePageToken(sql string, args []interface{}, keys []string, desc bool, values []interface{}) string {
+    var data codecs.IMData = codecs.IMSlice(values)
+    err, b := codecs.CodecIMv2.Encoder.Encode(&data)
+    if err != nil {
+        return ""
+    }
+    token := append(mysql.pageTokenMac(sql, args, keys, desc, b), b...)
+    return base64.RawURLEncoding.EncodeToString(token)
+}
+
+func (mysql *MySQL) decodePageToken(token string, sql string, args []interface{}, keys []string, desc bool) ([]interface{}, error) {
+    b, err := base64.RawURLEncoding.DecodeString(token)
+    if err != nil || len(b) <= pageTokenMacBytes {
+        return nil, ErrorInvalidPageToken
+    }
+    payload := b[pageTokenMacBytes:]
+    if !hmac.Equal(b[:pageTokenMacBytes], mysql.pageTokenMac(sql, args, keys, desc, payload)) {
+        return nil, ErrorInvalidPageToken
+    }
+    err, data, _ := codecs.CodecIMv2.Decoder.Decode(payload)
+    values, ok := data.(codecs.IMSlice)
+    if err != nil || !ok || len(values) != len(keys) {
+        return nil, ErrorInvalidPageToken
+    }
+    return values, nil
+}
+
+//pageKeyIndexes 返回排序列在结果中的位置, 列名不区分大小写
+func pageKeyIndexes(rows *sql.Rows, keys []string) ([]int, error) {
+    colTypes, err := rows.ColumnTypes()
+    if err != nil {
+        return nil, err
+    }
+    indexes := make([]int, len(keys))
+    for i, key := range keys {
+        indexes[i] = -1
+        for j, colType := range colTypes {
+            if strings.EqualFold(colType.Name(), key) {
+                indexes[i] = j
+                break
+            }
+        }
+        if indexes[i] < 0 {
+            return nil, ErrorPageKeyNotFound
+        }
+        if !pageKeyTypes[colTypes[indexes[i]].DatabaseTypeName()] {
+            return nil, ErrorPageKeyType
+        }
+    }
+    return indexes, nil
+}
+
+//QueryPage 以keyset方式分页. sql 为不含 ORDER BY/LIMIT 的查询, 作为派生表包装后按排序列比较取下一页,
+//不随页码变慢. 返回的续页标记为空表示没有更多数据.
+//排序列按解码后的值写入续页标记, 只接受整数、DECIMAL和字符串列
+func (mysql *MySQL) QueryPage(ctx context.Context, format int, sql string, args []interface{}, orderKey string, desc bool, pageSize int, token string) (interface{}, string, error) {
+    keys, err := parsePageKeys(orderKey)
+    if err != nil {
+        return nil, "", err
+    }
+    if pageSize <= 0 || pageSize > mysql.maxPageSize {
+        pageSize = mysql.maxPageSize
+    }
+
+    quoted := make([]string, len(keys))
+    placeholders := make([]string, len(keys))
+    orders := make([]string, len(keys))
+    direction, compare := "ASC", ">"
+    if desc {
+        direction, compare = "DESC", "<"
+    }
+    for i, key := range keys {
+        quoted[i] = "`" + key + "`"
+        placeholders[i] = "?"
+        orders[i] = quoted[i] + " " + direction
+    }
+
+    query := "SELECT * FROM (" + sql + ") AS _page"
+    queryArgs := append([]interface{}{}, args...)
+    if token != "" {
+        last, err := mysql.decodePageToken(token, sql, args, keys, desc)
+        if err != nil {
+            return nil, "", err
+        }
+        if len(keys) == 1 {
+            query += fmt.Sprintf(" WHERE %s %s ?", quoted[0], compare)
+        } else {
+            query += fmt.Sprintf(" WHERE (%s) %s (%s)", strings.Join(quoted, ","), compare, strings.Join(placeholders, ","))
+        }
+        queryArgs = append(queryArgs, last...)
+    }
+    //多取一行用于判断是否还有下一页
+    //LIMIT 同样使用占位符, 不同页大小的查询共用同一条预处理语句
+    query += " ORDER BY " + strings.Join(orders, ",") + " LIMIT ?"
+    queryArgs = append(queryArgs, pageSize+1)
+
+    rows, err := mysql.OpenRows(ctx, query, queryArgs...)
+    if err != nil {
+        return nil, "", err
+    }
+    defer rows.Close()
+    indexes, err := pageKeyIndexes(rows, keys)
+    if err != nil {
+        return nil, "", err
+    }
+
+    data := make([][]interface{}, 0, pageSize+1)
+    cols, err := mysql.scanRows(rows, func(cols []string, row []interface{}) bool {
+        data = append(data, row)
+        return true
+    })
+    if err != nil {
+        return nil, "", mysqlContextError(ctx, err)
+    }
+
+    next := ""
+    if len(data) > pageSize {
+        data = data[:pageSize]
+        last := data[pageSize-1]
+        values := make([]interface{}, len(keys))
+        for i, idx := range indexes {
+            values[i] = last[idx]
+        }
+        next = mysql.encodePageToken(sql, args, keys, desc, values)
+    }
+    return mysql.formatRows(format, cols, data), next, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/packing/clove/errors"
+)
+
+var (
+    ErrorQueryTimeout    = errors.Errorf("the query exceeded its timeout and was aborted")
+    ErrorQueryCancelled  = errors.Errorf("the query was cancelled by the client")
+    ErrorRequestNotFound = errors.Errorf("the request does not exist or has already finished")
+)
+
+type mysqlRequest struct {
+    cancel context.CancelFunc
+}
+
+//MySQLRequests 记录执行中的MySQL请求, 以客户端和请求的序号标识, 用于按序号取消正在执行的查询
+type MySQLRequests struct {
+    running map[string]*mysqlRequest
+    mutex   sync.Mutex
+}
+
+func CreateMySQLRequests() *MySQLRequests {
+    r := new(MySQLRequests)
+    r.running = make(map[string]*mysqlRequest)
+    return r
+}
+
+func mysqlRequestKey(owner string, serial int64) string {
+    return fmt.Sprintf("%s#%d", owner, serial)
+}
+
+//Start 为请求创建 context, timeout 为0时不限时长. 请求结束后需要调用返回的函数.
+//序号为0的请求无法被取消
+func (r *MySQLRequests) Start(owner string, serial int64, timeout time.Duration) (context.Context, func()) {
+    var ctx context.Context
+    var cancel context.CancelFunc
+    if timeout > 0 {
+        ctx, cancel = context.WithTimeout(context.Background(), timeout)
+    } else {
+        ctx, cancel = context.WithCancel(context.Background())
+    }
+    if serial == 0 {
+        return ctx, cancel
+    }
+
+    key := mysqlRequestKey(owner, serial)
+    req := &mysqlRequest{cancel: cancel}
+    r.mutex.Lock()
+    r.running[key] = req
+    r.mutex.Unlock()
+    return ctx, func() {
+        r.mutex.Lock()
+        if r.running[key] == req {
+            delete(r.running, key)
+        }
+        r.mutex.Unlock()
+        cancel()
+    }
+}
+
+func (r *MySQLRequests) Cancel(owner string, serial int64) error {
+    key := mysqlRequestKey(owner, serial)
+    r.mutex.Lock()
+    req, ok := r.running[key]
+    delete(r.running, key)
+    r.mutex.Unlock()
+    if !ok {
+        return ErrorRequestNotFound
+    }
+    req.cancel()
+    return nil
+}
+
+//mysqlContextError 请求超时或被取消时以对应的错误代替驱动返回的错误
+func mysqlContextError(ctx context.Context, err error) error {
+    if err == nil {
+        return nil
+    }
+    switch ctx.Err() {
+    case context.DeadlineExceeded:
+        return ErrorQueryTimeout
+    case context.Canceled:
+        return ErrorQueryCancelled
+    }
+    return err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+    "context"
+    "math/rand"
+    "sync/atomic"
+    "time"
+
+    mysqldriver "github.com/go-sql-driver/mysql"
+    "github.com/packing/clove/utils"
+)
+
+//可以通过重试解决的MySQL错误: 死锁和锁等待超时
+const (
+    mysqlErrorLockWaitTimeout = 1205
+    mysqlErrorDeadlock        = 1213
+)
+
+//mysqlRetry 遇到死锁或锁等待超时时按指数退避加随机抖动重试
+type mysqlRetry struct {
+    attempts  int
+    base      time.Duration
+    max       time.Duration
+    retries   int64
+    retried   int64
+    exhausted int64
+}
+
+func (r *mysqlRetry) init(config MySQLRetryConfig) {
+    r.attempts = config.Attempts
+    base, err := time.ParseDuration(config.BaseDelay)
+    if err == nil {
+        r.base = base
+    } else {
+        if config.BaseDelay != "" {
+            utils.LogWarn("mysql配置节中重试间隔retry.base的配置值可能有误")
+        }
+        r.base = time.Millisecond * 20
+    }
+    max, err := time.ParseDuration(config.MaxDelay)
+    if err == nil {
+        r.max = max
+    } else {
+        if config.MaxDelay != "" {
+            utils.LogWarn("mysql配置节中最大重试间隔retry.max的配置值可能有误")
+        }
+        r.max = time.Second
+    }
+}
+
+func isRetryableError(err error) bool {
+    e, ok := err.(*mysqldriver.MySQLError)
+    if !ok {
+        return false
+    }
+    return e.Number == mysqlErrorDeadlock || e.Number == mysqlErrorLockWaitTimeout
+}
+
+//backoff 第n次重试前的等待时长, 在 [d/2, d) 之间随机, d 按次数翻倍且不超过 max
+func (r *mysqlRetry) backoff(n int) time.Duration {
+    d := r.base << uint(n)
+    if d > r.max || d <= 0 {
+        d = r.max
+    }
+    half := int64(d / 2)
+    if half <= 0 {
+        return d
+    }
+    return time.Duration(half + rand.Int63n(half))
+}
+
+//do 执行 fn, 返回的错误可重试时按配置重试, 返回重试的次数和最后一次的错误. ctx 结束后不再重试
+func (r *mysqlRetry) do(ctx context.Context, fn func() error) (int, error) {
+    n := 0
+    for {
+        err := fn()
+        if err == nil || !isRetryableError(err) || ctx.Err() != nil {
+            if n > 0 {
+                atomic.AddInt64(&r.retried, 1)
+            }
+            return n, err
+        }
+        if n >= r.attempts {
+            if r.attempts > 0 {
+                atomic.AddInt64(&r.exhausted, 1)
+                utils.LogWarn("MySQL重试 %d 次后仍然失败: %s", n, err.Error())
+            }
+            return n, err
+        }
+        timer := time.NewTimer(r.backoff(n))
+        select {
+        case <-timer.C:
+        case <-ctx.Done():
+            timer.Stop()
+            return n, err
+        }
+        n += 1
+        atomic.AddInt64(&r.retries, 1)
+    }
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+    "container/list"
+    "context"
+    "database/sql"
+    "database/sql/driver"
+    "strings"
+    "sync"
+    "sync/atomic"
+
+    mysqldriver "github.com/go-sql-driver/mysql"
+)
+
+//服务器端的预处理语句已失效: Unknown prepared statement handler
+const mysqlErrorUnknownStmt = 1243
+
+type mysqlStmt struct {
+    query   string
+    stmt    *sql.Stmt
+    refs    int
+    evicted bool
+}
+
+//mysqlStmtCache 以SQL文本为键缓存预处理语句, 超出容量时淘汰最久未使用的语句.
+//语句在使用期间被淘汰时推迟到最后一个使用者归还后再关闭
+type mysqlStmtCache struct {
+    capacity    int
+    lru         *list.List
+    entries     map[string]*list.Element
+    hits        int64
+    misses      int64
+    evictions   int64
+    invalidated int64
+    mutex       sync.Mutex
+}
+
+//init 容量为0时使用默认值, 小于0时不缓存
+func (c *mysqlStmtCache) init(capacity int) {
+    c.capacity = capacity
+    if c.capacity == 0 {
+        c.capacity = 256
+    }
+    c.lru = list.New()
+    c.entries = make(map[string]*list.Element)
+}
+
+//get 取得语句并增加引用, 用完后需要 put. 不缓存或预处理失败时返回nil, 由调用方直接执行SQL.
+//不含占位符的SQL通常是拼接了参数的一次性语句, 缓存只会挤掉常用的语句, 同样返回nil
+func (c *mysqlStmtCache) get(ctx context.Context, db *sql.DB, query string) *mysqlStmt {
+    if c.capacity < 0 || !strings.Contains(query, "?") {
+        return nil
+    }
+    c.mutex.Lock()
+    if e, ok := c.entries[query]; ok {
+        c.lru.MoveToFront(e)
+        s := e.Value.(*mysqlStmt)
+        s.refs += 1
+        c.mutex.Unlock()
+        atomic.AddInt64(&c.hits, 1)
+        return s
+    }
+    c.mutex.Unlock()
+    atomic.AddInt64(&c.misses, 1)
+
+    stmt, err := db.PrepareContext(ctx, query)
+    if err != nil {
+        return nil
+    }
+
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    if e, ok := c.entries[query]; ok {
+        //其他请求已经预处理了同样的语句
+        stmt.Close()
+        c.lru.MoveToFront(e)
+        s := e.Value.(*mysqlStmt)
+        s.refs += 1
+        return s
+    }
+    s := &mysqlStmt{query: query, stmt: stmt, refs: 1}
+    c.entries[query] = c.lru.PushFront(s)
+    for c.lru.Len() > c.capacity {
+        c.remove(c.lru.Back())
+        atomic.AddInt64(&c.evictions, 1)
+    }
+    return s
+}
+
+func (c *mysqlStmtCache) put(s *mysqlStmt) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    s.refs -= 1
+    if s.refs == 0 && s.evicted {
+        s.stmt.Close()
+    }
+}
+
+//remove 调用方需持有 mutex
+func (c *mysqlStmtCache) remove(e *list.Element) {
+    s := e.Value.(*mysqlStmt)
+    c.lru.Remove(e)
+    delete(c.entries, s.query)
+    s.evicted = true
+    if s.refs == 0 {
+        s.stmt.Close()
+    }
+}
+
+//check 执行出现连接层面的错误时丢弃该语句, 下次使用时重新预处理
+func (c *mysqlStmtCache) check(s *mysqlStmt, err error) {
+    if !isStmtInvalidError(err) {
+        return
+    }
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    if e, ok := c.entries[s.query]; ok && e.Value == s {
+        c.remove(e)
+        atomic.AddInt64(&c.invalidated, 1)
+    }
+}
+
+func isStmtInvalidError(err error) bool {
+    switch err {
+    case nil:
+        return false
+    case driver.ErrBadConn, mysqldriver.ErrInvalidConn, sql.ErrConnDone:
+        return true
+    }
+    e, ok := err.(*mysqldriver.MySQLError)
+    return ok && e.Number == mysqlErrorUnknownStmt
+}
+
+func (mysql *MySQL) dbQuery(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+    s := mysql.stmts.get(ctx, mysql.db, query)
+    if s == nil {
+        return mysql.db.QueryContext(ctx, query, args...)
+    }
+    defer mysql.stmts.put(s)
+    rows, err := s.stmt.QueryContext(ctx, args...)
+    mysql.stmts.check(s, err)
+    return rows, err
+}
+
+func (mysql *MySQL) dbExec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+    s := mysql.stmts.get(ctx, mysql.db, query)
+    if s == nil {
+        return mysql.db.ExecContext(ctx, query, args...)
+    }
+    defer mysql.stmts.put(s)
+    result, err := s.stmt.ExecContext(ctx, args...)
+    mysql.stmts.check(s, err)
+    return result, err
+}
+
+//txQuery 在事务中通过 tx.Stmt 使用缓存的语句. 读完结果后需要调用返回的 done,
+//它关闭 rows 以及事务内的语句, 出错时不需要调用
+func (mysql *MySQL) txQuery(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (*sql.Rows, func(), error) {
+    s := mysql.stmts.get(ctx, mysql.db, query)
+    if s == nil {
+        rows, err := tx.QueryContext(ctx, query, args...)
+        if err != nil {
+            return nil, nil, err
+        }
+        return rows, func() { rows.Close() }, nil
+    }
+    stmt := tx.StmtContext(ctx, s.stmt)
+    rows, err := stmt.QueryContext(ctx, args...)
+    mysql.stmts.check(s, err)
+    if err != nil {
+        stmt.Close()
+        mysql.stmts.put(s)
+        return nil, nil, err
+    }
+    return rows, func() {
+        rows.Close()
+        stmt.Close()
+        mysql.stmts.put(s)
+    }, nil
+}
+
+func (mysql *MySQL) txExec(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (sql.Result, error) {
+    s := mysql.stmts.get(ctx, mysql.db, query)
+    if s == nil {
+        return tx.ExecContext(ctx, query, args...)
+    }
+    defer mysql.stmts.put(s)
+    stmt := tx.StmtContext(ctx, s.stmt)
+    defer stmt.Close()
+    result, err := stmt.ExecContext(ctx, args...)
+    mysql.stmts.check(s, err)
+    return result, err
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "sync"
+    "time"
+
+    "github.com/packing/clove/codecs"
+    "github.com/packing/clove/errors"
+    "github.com/packing/clove/messages"
+    "github.com/packing/clove/utils"
+)
+
+var (
+    ErrorStreamNotFound = errors.Errorf("the query stream does not exist")
+    ErrorStreamIdle     = errors.Errorf("the query stream was cancelled after waiting too long for the client")
+)
+
+//mysqlStream 一次流式查询. 结果按行数和估算字节数切分为块, 每块消耗一个额度,
+//额度耗尽后暂停读取, 直到客户端通过 ProtocolTypeDBStreamNext 追加额度
+type mysqlStream struct {
+    id        uint64
+    target    *pushTarget
+    rows      *sql.Rows
+    stopQuery context.CancelFunc
+    format    int
+    chunkRows int
+    credits   int
+    cancelled bool
+    wake      chan struct{}
+    mutex     sync.Mutex
+}
+
+//MySQLStreams 管理进行中的流式查询. TCP客户端断开时通过 CloseOwner 取消其查询;
+//unix 地址的客户端没有断开通知, 它的查询只能在等待额度超过 streamIdle 后取消
+type MySQLStreams struct {
+    streams    map[uint64]*mysqlStream
+    nextId     uint64
+    chunkRows  int
+    chunkBytes int64
+    idle       time.Duration
+    mutex      sync.Mutex
+}
+
+func CreateMySQLStreams(config MySQLConfig) *MySQLStreams {
+    s := new(MySQLStreams)
+    s.streams = make(map[uint64]*mysqlStream)
+    s.chunkRows = config.StreamChunkRows
+    if s.chunkRows <= 0 {
+        s.chunkRows = 500
+    }
+    s.chunkBytes = int64(config.StreamChunkBytes)
+    if s.chunkBytes <= 0 {
+        s.chunkBytes = 1024 * 1024
+    }
+    idle, err := time.ParseDuration(config.StreamIdle)
+    if err == nil {
+        s.idle = idle
+    } else {
+        if config.StreamIdle != "" {
+            utils.LogWarn("mysql配置节中流式查询等待时长streamIdle的配置值可能有误")
+        }
+        s.idle = time.Minute
+    }
+    return s
+}
+
+//Start 执行查询并登记流, 查询本身的错误直接返回给请求方. window 为初始额度.
+//调用方把流id应答给客户端之后再调用 Run 开始推送, 保证客户端先知道流id
+func (s *MySQLStreams) Start(target *pushTarget, format int, chunkRows int, window int, sql string, args ...interface{}) (uint64, error) {
+    //流式查询由客户端通过额度和取消控制, 不受查询超时的限制. 每个查询使用单独的 context, 取消时中断服务端的查询
+    ctx, stopQuery := context.WithCancel(context.Background())
+    rows, err := mysqlClient.OpenRows(ctx, sql, args...)
+    if err != nil {
+        stopQuery()
+        return 0, err
+    }
+    if chunkRows <= 0 || chunkRows > s.chunkRows {
+        chunkRows = s.chunkRows
+    }
+    if window <= 0 {
+        window = 1
+    }
+
+    s.mutex.Lock()
+    s.nextId += 1
+    stream := &mysqlStream{id: s.nextId, target: target, rows: rows, stopQuery: stopQuery, format: format, chunkRows: chunkRows, credits: window}
+    stream.wake = make(chan struct{}, 1)
+    s.streams[stream.id] = stream
+    s.mutex.Unlock()
+    return stream.id, nil
+}
+
+//Run 开始推送 Start 登记的流
+func (s *MySQLStreams) Run(id uint64) {
+    s.mutex.Lock()
+    stream, ok := s.streams[id]
+    s.mutex.Unlock()
+    if ok {
+        go s.run(stream)
+    }
+}
+
+func (s *MySQLStreams) get(id uint64, owner string) *mysqlStream {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    stream, ok := s.streams[id]
+    if !ok || stream.target.owner != owner {
+        return nil
+    }
+    return stream
+}
+
+//Next 追加额度
+func (s *MySQLStreams) Next(id uint64, owner string, credits int) error {
+    stream := s.get(id, owner)
+    if stream == nil {
+        return ErrorStreamNotFound
+    }
+    if credits <= 0 {
+        credits = 1
+    }
+    stream.mutex.Lock()
+    stream.credits += credits
+    stream.mutex.Unlock()
+    stream.notify()
+    return nil
+}
+
+//Cancel 取消查询并关闭 sql.Rows, 之后不再推送任何数据
+func (s *MySQLStreams) Cancel(id uint64, owner string) error {
+    stream := s.get(id, owner)
+    if stream == nil {
+        return ErrorStreamNotFound
+    }
+    stream.cancel()
+    return nil
+}
+
+//CloseOwner 客户端断开时取消其全部流式查询
+func (s *MySQLStreams) CloseOwner(owner string) {
+    s.mutex.Lock()
+    streams := make([]*mysqlStream, 0)
+    for _, stream := range s.streams {
+        if stream.target.owner == owner {
+            streams = append(streams, stream)
+        }
+    }
+    s.mutex.Unlock()
+    for _, stream := range streams {
+        stream.cancel()
+    }
+}
+
+func (stream *mysqlStream) notify() {
+    select {
+    case stream.wake <- struct{}{}:
+    default:
+    }
+}
+
+func (stream *mysqlStream) cancel() {
+    stream.mutex.Lock()
+    stream.cancelled = true
+    stream.mutex.Unlock()
+    //先取消 context, 否则 rows.Close 需要读完服务端剩余的结果
+    stream.stopQuery()
+    stream.rows.Close()
+    stream.notify()
+}
+
+//acquire 消耗一个额度, 等待超时或被取消时返回错误
+func (stream *mysqlStream) acquire(idle time.Duration) error {
+    timer := time.NewTimer(idle)
+    defer timer.Stop()
+    for {
+        stream.mutex.Lock()
+        if stream.cancelled {
+            stream.mutex.Unlock()
+            return ErrorStreamNotFound
+        }
+        if stream.credits > 0 {
+            stream.credits -= 1
+            stream.mutex.Unlock()
+            return nil
+        }
+        stream.mutex.Unlock()
+
+        select {
+        case <-stream.wake:
+        case <-timer.C:
+            return ErrorStreamIdle
+        }
+    }
+}
+
+func (s *MySQLStreams) run(stream *mysqlStream) {
+    defer func() {
+        stream.stopQuery()
+        stream.rows.Close()
+        s.mutex.Lock()
+        delete(s.streams, stream.id)
+        s.mutex.Unlock()
+    }()
+
+    seq := 0
+    buffer := make([][]interface{}, 0, stream.chunkRows)
+    var size int64
+    var sendErr error
+    cols, err := mysqlClient.scanRows(stream.rows, func(cols []string, row []interface{}) bool {
+        buffer = append(buffer, row)
+        for _, v := range row {
+            size += estimateValueSize(v)
+        }
+        if len(buffer) < stream.chunkRows && size < s.chunkBytes {
+            return true
+        }
+        sendErr = stream.acquire(s.idle)
+        if sendErr != nil {
+            return false
+        }
+        stream.send(seq, mysqlClient.formatRows(stream.format, cols, buffer), false, nil)
+        seq += 1
+        buffer = make([][]interface{}, 0, stream.chunkRows)
+        size = 0
+        return true
+    })
+
+    if sendErr == nil {
+        sendErr = stream.acquire(s.idle)
+    }
+    switch sendErr {
+    case nil:
+    case ErrorStreamIdle:
+        //客户端长时间不追加额度, 丢弃未发送的数据, 以不占额度的结束块告知原因
+        utils.LogWarn("流式查询 %d 等待客户端超时, 已取消", stream.id)
+        err = sendErr
+        buffer = buffer[:0]
+    default:
+        return
+    }
+    stream.send(seq, mysqlClient.formatRows(stream.format, cols, buffer), true, err)
+}
+
+func (stream *mysqlStream) send(seq int, data interface{}, end bool, err error) {
+    body := make(codecs.IMMap)
+    body[ProtocolKeyStreamId] = stream.id
+    body[ProtocolKeySeq] = seq
+    body[messages.ProtocolKeyResult] = data
+    body[ProtocolKeyEnd] = end
+    if err != nil {
+        body[ProtocolKeyError] = err.Error()
+    }
+    stream.target.push(body)
+}
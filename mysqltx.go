@@ -0,0 +1,246 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "sync"
+    "time"
+
+    "github.com/packing/clove/errors"
+    "github.com/packing/clove/utils"
+)
+
+var (
+    ErrorTxNotFound  = errors.Errorf("the transaction does not exist or has already finished")
+    ErrorTxLimit     = errors.Errorf("too many open transactions")
+    //语句超时或被取消时连接上可能仍有未完成的语句, 事务随之回滚
+    ErrorTxTimeout   = errors.Errorf("the statement timed out and the transaction was rolled back")
+    ErrorTxCancelled = errors.Errorf("the statement was cancelled and the transaction was rolled back")
+)
+
+//mysqlTx 一个跨多条消息的事务, 同一事务上的操作串行执行
+type mysqlTx struct {
+    id       uint64
+    owner    string
+    tx       *sql.Tx
+    timer    *time.Timer
+    finished bool
+    mutex    sync.Mutex
+}
+
+//MySQLTransactions 管理由客户端逐条发起语句的交互式事务. 事务以 storage 分配的id标识,
+//超过空闲时长没有任何操作或客户端断开时自动回滚. 每个事务独占一条连接, 同时打开的事务数受 txLimit 限制,
+//避免交互式事务占满连接池
+type MySQLTransactions struct {
+    txs     map[uint64]*mysqlTx
+    nextId  uint64
+    idle    time.Duration
+    limit   int
+    opening int
+    mutex   sync.Mutex
+}
+
+func CreateMySQLTransactions(config MySQLConfig) *MySQLTransactions {
+    t := new(MySQLTransactions)
+    t.txs = make(map[uint64]*mysqlTx)
+    idle, err := time.ParseDuration(config.TxIdle)
+    if err == nil {
+        t.idle = idle
+    } else {
+        if config.TxIdle != "" {
+            utils.LogWarn("mysql配置节中事务空闲时长txIdle的配置值可能有误")
+        }
+        t.idle = time.Second * 30
+    }
+    t.limit = config.TxLimit
+    if t.limit <= 0 {
+        //默认最多占用连接池的一半
+        t.limit = config.PoolSize / 2
+        if t.limit <= 0 {
+            t.limit = 64
+        }
+    }
+    return t
+}
+
+func (t *MySQLTransactions) Begin(owner string, opts *sql.TxOptions) (uint64, error) {
+    t.mutex.Lock()
+    if len(t.txs)+t.opening >= t.limit {
+        t.mutex.Unlock()
+        utils.LogWarn("同时打开的事务已达上限 %d, 拒绝新的事务", t.limit)
+        return 0, ErrorTxLimit
+    }
+    t.opening += 1
+    t.mutex.Unlock()
+
+    //事务跨越多个请求, 不能绑定在单个请求的 context 上
+    tx, err := mysqlClient.db.BeginTx(context.Background(), opts)
+    if err != nil {
+        t.mutex.Lock()
+        t.opening -= 1
+        t.mutex.Unlock()
+        utils.LogError("============= MySQL Begin Error =============")
+        utils.LogError(">>> Description: %s", err.Error())
+        utils.LogError("=============================================")
+        return 0, err
+    }
+
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+    t.opening -= 1
+    t.nextId += 1
+    mtx := &mysqlTx{id: t.nextId, owner: owner, tx: tx}
+    mtx.timer = time.AfterFunc(t.idle, func() {
+        if t.finish(mtx, false) == nil {
+            utils.LogWarn("事务 %d 空闲超时, 已自动回滚", mtx.id)
+        }
+    })
+    t.txs[mtx.id] = mtx
+    return mtx.id, nil
+}
+
+//acquire 取得事务并锁定, 成功时推迟空闲超时, 调用方需要 release
+func (t *MySQLTransactions) acquire(id uint64, owner string) (*mysqlTx, error) {
+    t.mutex.Lock()
+    mtx, ok := t.txs[id]
+    t.mutex.Unlock()
+    if !ok || mtx.owner != owner {
+        return nil, ErrorTxNotFound
+    }
+    mtx.mutex.Lock()
+    if mtx.finished {
+        mtx.mutex.Unlock()
+        return nil, ErrorTxNotFound
+    }
+    mtx.timer.Stop()
+    return mtx, nil
+}
+
+func (t *MySQLTransactions) release(mtx *mysqlTx) {
+    if !mtx.finished {
+        mtx.timer.Reset(t.idle)
+    }
+    mtx.mutex.Unlock()
+}
+
+func (t *MySQLTransactions) Exec(ctx context.Context, id uint64, owner string, sql string, args ...interface{}) (int64, error) {
+    mtx, err := t.acquire(id, owner)
+    if err != nil {
+        return 0, err
+    }
+    defer t.release(mtx)
+
+    result, err := mysqlClient.txExec(ctx, mtx.tx, sql, args...)
+    if err != nil {
+        utils.LogError("============= MySQL Query Error =============")
+        utils.LogError(">>> Sql: %s", sql)
+        if len(args) > 0 {
+            utils.LogError(">>> Args: %v", args)
+        }
+        utils.LogError(">>> Description: %s", err.Error())
+        utils.LogError("=============================================")
+        return 0, t.contextError(ctx, mtx, err)
+    }
+    return execResult(result), nil
+}
+
+func (t *MySQLTransactions) Query(ctx context.Context, id uint64, owner string, format int, sql string, args ...interface{}) (interface{}, error) {
+    mtx, err := t.acquire(id, owner)
+    if err != nil {
+        return nil, err
+    }
+    defer t.release(mtx)
+
+    rows, done, err := mysqlClient.txQuery(ctx, mtx.tx, sql, args...)
+    if err != nil {
+        utils.LogError("============= MySQL Query Error =============")
+        utils.LogError(">>> Sql: %s", sql)
+        if len(args) > 0 {
+            utils.LogError(">>> Args: %v", args)
+        }
+        utils.LogError(">>> Description: %s", err.Error())
+        utils.LogError("=============================================")
+        return nil, t.contextError(ctx, mtx, err)
+    }
+    results, err := mysqlClient.ReadRowsAs(rows, format)
+    done()
+    if err != nil {
+        return nil, t.contextError(ctx, mtx, err)
+    }
+    return results, nil
+}
+
+//contextError 语句因超时或取消失败时回滚并移除事务, 调用方需持有事务的 mutex
+func (t *MySQLTransactions) contextError(ctx context.Context, mtx *mysqlTx, err error) error {
+    switch ctx.Err() {
+    case context.DeadlineExceeded:
+        err = ErrorTxTimeout
+    case context.Canceled:
+        err = ErrorTxCancelled
+    default:
+        return err
+    }
+    t.finishLocked(mtx, false)
+    utils.LogWarn("事务 %d 的语句超时或被取消, 已回滚", mtx.id)
+    return err
+}
+
+func (t *MySQLTransactions) Commit(id uint64, owner string) error {
+    mtx, err := t.acquire(id, owner)
+    if err != nil {
+        return err
+    }
+    mtx.mutex.Unlock()
+    return t.finish(mtx, true)
+}
+
+func (t *MySQLTransactions) Rollback(id uint64, owner string) error {
+    mtx, err := t.acquire(id, owner)
+    if err != nil {
+        return err
+    }
+    mtx.mutex.Unlock()
+    return t.finish(mtx, false)
+}
+
+//finish 提交或回滚并移除事务, 事务已经结束时返回 ErrorTxNotFound
+func (t *MySQLTransactions) finish(mtx *mysqlTx, commit bool) error {
+    mtx.mutex.Lock()
+    defer mtx.mutex.Unlock()
+    return t.finishLocked(mtx, commit)
+}
+
+//finishLocked 同 finish, 调用方需持有事务的 mutex
+func (t *MySQLTransactions) finishLocked(mtx *mysqlTx, commit bool) error {
+    if mtx.finished {
+        return ErrorTxNotFound
+    }
+    mtx.finished = true
+    mtx.timer.Stop()
+
+    t.mutex.Lock()
+    delete(t.txs, mtx.id)
+    t.mutex.Unlock()
+
+    if commit {
+        return mtx.tx.Commit()
+    }
+    return mtx.tx.Rollback()
+}
+
+//CloseOwner 客户端断开时回滚其全部未结束的事务
+func (t *MySQLTransactions) CloseOwner(owner string) {
+    t.mutex.Lock()
+    txs := make([]*mysqlTx, 0)
+    for _, mtx := range t.txs {
+        if mtx.owner == owner {
+            txs = append(txs, mtx)
+        }
+    }
+    t.mutex.Unlock()
+    for _, mtx := range txs {
+        if t.finish(mtx, false) == nil {
+            utils.LogInfo("客户端已断开, 事务 %d 已回滚", mtx.id)
+        }
+    }
+}
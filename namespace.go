@@ -0,0 +1,260 @@
+package main
+
+import (
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/packing/clove/errors"
+    "github.com/packing/clove/utils"
+)
+
+var ErrorNamespaceCommand = errors.Errorf("NOPERM command is not available inside a namespace")
+
+//在命名空间内无法限定作用范围的全局命令
+var namespaceDeniedCommands = map[string]bool{
+    "flushall":  true,
+    "flushdb":   true,
+    "randomkey": true,
+    "dbsize":    true,
+    "swapdb":    true,
+    "move":      true,
+    "migrate":   true,
+}
+
+//不涉及key, 在命名空间内可以直接执行的命令. 其余没有key的命令无法限定作用范围, 一律拒绝
+var namespaceKeylessCommands = map[string]bool{
+    "ping":    true,
+    "echo":    true,
+    "time":    true,
+    "command": true,
+    "multi":   true,
+    "exec":    true,
+    "discard": true,
+    "unwatch": true,
+}
+
+type namespacedCmd struct {
+    ns  string
+    cmd string
+}
+
+type namespacedPipeline struct {
+    owner   string
+    cmds    []namespacedCmd
+    lastUse time.Time
+}
+
+//KeyNamespaces 为不同租户的key加上命名空间前缀. 命名空间可以在配置中按客户端(unix地址或TCP对端主机)分配,
+//也可以由客户端在请求中通过 ProtocolKeyNamespace 声明, 配置分配的命名空间优先且不能被请求覆盖.
+//key参数的位置取自 redisKeyIndexes, KEYS/SCAN 的匹配模式同样加上前缀, 返回的key去掉前缀.
+//PUBLISH 和订阅的频道名也加上同样的前缀, 不同命名空间之间的消息互不可见
+type KeyNamespaces struct {
+    separator string
+    assigned  map[string]string
+    pipelines map[uint64]*namespacedPipeline
+    idle      time.Duration
+    mutex     sync.Mutex
+}
+
+func CreateKeyNamespaces(redisConfig RedisConfig) *KeyNamespaces {
+    config := redisConfig.Namespace
+    n := new(KeyNamespaces)
+    //管道记录与独占连接同样按 forkIdle 回收, 配置有误的警告已由独占连接给出
+    idle, err := time.ParseDuration(redisConfig.ForkIdleTime)
+    if err != nil {
+        idle = time.Minute * 5
+    }
+    n.idle = idle
+    n.separator = config.Separator
+    if n.separator == "" {
+        n.separator = ":"
+    }
+    n.assigned = config.Clients
+    if n.assigned == nil {
+        n.assigned = make(map[string]string)
+    }
+    n.pipelines = make(map[uint64]*namespacedPipeline)
+    go n.reapPipelines()
+    return n
+}
+
+//Resolve 返回请求实际使用的命名空间, 空字符串表示不加前缀
+func (n *KeyNamespaces) Resolve(client string, declared string) string {
+    ns, ok := n.assigned[client]
+    if ok {
+        return ns
+    }
+    return declared
+}
+
+func (n *KeyNamespaces) prefix(ns string) string {
+    return ns + n.separator
+}
+
+//ChannelPrefix 返回订阅和发布频道使用的前缀, 频道名与key共用同一个前缀
+func (n *KeyNamespaces) ChannelPrefix(ns string) string {
+    if ns == "" {
+        return ""
+    }
+    return n.prefix(ns)
+}
+
+//RewriteArgs 返回加上前缀后的参数副本, 原参数不会被修改
+func (n *KeyNamespaces) RewriteArgs(ns string, cmd string, args []interface{}) ([]interface{}, error) {
+    if ns == "" {
+        return args, nil
+    }
+    cmd = strings.ToLower(cmd)
+    if namespaceDeniedCommands[cmd] {
+        return nil, ErrorNamespaceCommand
+    }
+    prefix := n.prefix(ns)
+    rewritten := make([]interface{}, len(args))
+    copy(rewritten, args)
+
+    switch cmd {
+    case "keys":
+        if len(rewritten) > 0 {
+            rewritten[0] = prefix + redisArgString(rewritten[0])
+        }
+        return rewritten, nil
+    case "scan":
+        for i := 1; i < len(rewritten)-1; i++ {
+            if strings.ToLower(redisArgString(rewritten[i])) == "match" {
+                rewritten[i+1] = prefix + redisArgString(rewritten[i+1])
+                return rewritten, nil
+            }
+        }
+        return append(rewritten, "MATCH", prefix+"*"), nil
+    case "publish":
+        if len(rewritten) > 0 {
+            rewritten[0] = prefix + redisArgString(rewritten[0])
+        }
+        return rewritten, nil
+    }
+
+    if redisKeysUnknown(cmd, rewritten) {
+        return nil, ErrorNamespaceCommand
+    }
+    indexes := redisKeyIndexes(cmd, rewritten)
+    if len(indexes) == 0 && !namespaceKeylessCommands[cmd] {
+        return nil, ErrorNamespaceCommand
+    }
+    for _, i := range indexes {
+        rewritten[i] = prefix + redisArgString(rewritten[i])
+    }
+    return rewritten, nil
+}
+
+func (n *KeyNamespaces) stripKey(prefix string, v interface{}) interface{} {
+    switch k := v.(type) {
+    case string:
+        return strings.TrimPrefix(k, prefix)
+    case []byte:
+        return []byte(strings.TrimPrefix(string(k), prefix))
+    }
+    return v
+}
+
+//StripReply 去掉应答中key的前缀, 只处理返回key的命令
+func (n *KeyNamespaces) StripReply(ns string, cmd string, reply interface{}) interface{} {
+    if ns == "" || reply == nil {
+        return reply
+    }
+    prefix := n.prefix(ns)
+    switch strings.ToLower(cmd) {
+    case "keys":
+        keys, ok := reply.([]interface{})
+        if !ok {
+            return reply
+        }
+        stripped := make([]interface{}, len(keys))
+        for i, k := range keys {
+            stripped[i] = n.stripKey(prefix, k)
+        }
+        return stripped
+    case "scan":
+        ret, ok := reply.([]interface{})
+        if !ok || len(ret) != 2 {
+            return reply
+        }
+        return []interface{}{ret[0], n.StripReply(ns, "keys", ret[1])}
+    case "blpop", "brpop", "bzpopmin", "bzpopmax":
+        ret, ok := reply.([]interface{})
+        if !ok || len(ret) == 0 {
+            return reply
+        }
+        stripped := make([]interface{}, len(ret))
+        copy(stripped, ret)
+        stripped[0] = n.stripKey(prefix, ret[0])
+        return stripped
+    }
+    return reply
+}
+
+//Pipelined 记录管道中已发送的命令, Receive 时按顺序取出以还原应答.
+//不带命名空间的命令同样要记录, 否则同一管道中前后命令的应答会错位
+func (n *KeyNamespaces) Pipelined(key uint64, owner string, ns string, cmd string) {
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+    p, ok := n.pipelines[key]
+    if !ok {
+        p = &namespacedPipeline{owner: owner}
+        n.pipelines[key] = p
+    }
+    p.cmds = append(p.cmds, namespacedCmd{ns: ns, cmd: cmd})
+    p.lastUse = time.Now()
+}
+
+func (n *KeyNamespaces) Received(key uint64, reply interface{}) interface{} {
+    n.mutex.Lock()
+    p, ok := n.pipelines[key]
+    if !ok || len(p.cmds) == 0 {
+        n.mutex.Unlock()
+        return reply
+    }
+    c := p.cmds[0]
+    p.cmds = p.cmds[1:]
+    if len(p.cmds) == 0 {
+        delete(n.pipelines, key)
+    }
+    n.mutex.Unlock()
+    return n.StripReply(c.ns, c.cmd, reply)
+}
+
+//reapPipelines 回收应答未被取走的管道记录: 长时间未使用(对应的独占连接也已被回收), 或所属unix地址已不存在
+func (n *KeyNamespaces) reapPipelines() {
+    interval := n.idle / 4
+    if interval < time.Second {
+        interval = time.Second
+    } else if interval > time.Second*30 {
+        interval = time.Second * 30
+    }
+    for range time.Tick(interval) {
+        n.mutex.Lock()
+        for key, p := range n.pipelines {
+            if time.Since(p.lastUse) > n.idle || unixOwnerGone(p.owner) {
+                delete(n.pipelines, key)
+                utils.LogInfo("回收命名空间管道记录 %d, 所属 %s", key, p.owner)
+            }
+        }
+        n.mutex.Unlock()
+    }
+}
+
+func (n *KeyNamespaces) Close(key uint64) {
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+    delete(n.pipelines, key)
+}
+
+func (n *KeyNamespaces) CloseOwner(owner string) {
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+    for key, p := range n.pipelines {
+        if p.owner == owner {
+            delete(n.pipelines, key)
+        }
+    }
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestKeyNamespacesRewriteArgs(t *testing.T) {
+    n := CreateKeyNamespaces(RedisConfig{})
+    cases := []struct {
+        cmd  string
+        args []interface{}
+        want []interface{}
+        err  error
+    }{
+        {"get", []interface{}{"a"}, []interface{}{"t1:a"}, nil},
+        {"SET", []interface{}{"a", "v", "EX", 10}, []interface{}{"t1:a", "v", "EX", 10}, nil},
+        {"mset", []interface{}{"a", "1", "b", "2"}, []interface{}{"t1:a", "1", "t1:b", "2"}, nil},
+        {"bitop", []interface{}{"AND", "d", "a"}, []interface{}{"AND", "t1:d", "t1:a"}, nil},
+        {"eval", []interface{}{"return 1", 1, "a", "x"}, []interface{}{"return 1", 1, "t1:a", "x"}, nil},
+        {"xread", []interface{}{"STREAMS", "s", "0"}, []interface{}{"STREAMS", "t1:s", "0"}, nil},
+        //匹配模式同样加上前缀, SCAN 没有 MATCH 时补上
+        {"keys", []interface{}{"u*"}, []interface{}{"t1:u*"}, nil},
+        {"scan", []interface{}{0, "MATCH", "u*"}, []interface{}{0, "MATCH", "t1:u*"}, nil},
+        {"scan", []interface{}{0}, []interface{}{0, "MATCH", "t1:*"}, nil},
+        //频道名加上前缀
+        {"publish", []interface{}{"ch", "msg"}, []interface{}{"t1:ch", "msg"}, nil},
+        //不涉及key的命令原样执行
+        {"ping", []interface{}{}, []interface{}{}, nil},
+        {"multi", []interface{}{}, []interface{}{}, nil},
+        //无法限定作用范围的命令被拒绝
+        {"flushall", nil, nil, ErrorNamespaceCommand},
+        {"randomkey", nil, nil, ErrorNamespaceCommand},
+        {"sort", []interface{}{"a", "BY", "w_*"}, nil, ErrorNamespaceCommand},
+        {"script", []interface{}{"FLUSH"}, nil, ErrorNamespaceCommand},
+        {"get", []interface{}{}, nil, ErrorNamespaceCommand},
+    }
+    for _, c := range cases {
+        got, err := n.RewriteArgs("t1", c.cmd, c.args)
+        if err != c.err || (err == nil && !reflect.DeepEqual(got, c.want)) {
+            t.Errorf("RewriteArgs(%s %v) = %v, %v, want %v, %v", c.cmd, c.args, got, err, c.want, c.err)
+        }
+    }
+
+    //不在命名空间中时原样返回
+    args := []interface{}{"a"}
+    got, err := n.RewriteArgs("", "flushall", args)
+    if err != nil || !reflect.DeepEqual(got, args) {
+        t.Errorf("RewriteArgs without a namespace = %v, %v", got, err)
+    }
+    //原参数不被修改
+    args = []interface{}{"a"}
+    n.RewriteArgs("t1", "get", args)
+    if args[0] != "a" {
+        t.Errorf("RewriteArgs modified its input: %v", args)
+    }
+}
+
+func TestKeyNamespacesResolve(t *testing.T) {
+    n := CreateKeyNamespaces(RedisConfig{Namespace: NamespaceConfig{Separator: "/", Clients: map[string]string{"/tmp/a.sock": "a"}}})
+    if ns := n.Resolve("/tmp/a.sock", "b"); ns != "a" {
+        t.Errorf("assigned namespace should win over the declared one, got %q", ns)
+    }
+    if ns := n.Resolve("/tmp/c.sock", "b"); ns != "b" {
+        t.Errorf("declared namespace should be used when none is assigned, got %q", ns)
+    }
+    if p := n.ChannelPrefix("a"); p != "a/" {
+        t.Errorf("ChannelPrefix(a) = %q", p)
+    }
+    if p := n.ChannelPrefix(""); p != "" {
+        t.Errorf("ChannelPrefix(\"\") = %q", p)
+    }
+}
+
+func TestKeyNamespacesStripReply(t *testing.T) {
+    n := CreateKeyNamespaces(RedisConfig{})
+    keys := n.StripReply("t1", "keys", []interface{}{"t1:a", []byte("t1:b")})
+    if !reflect.DeepEqual(keys, []interface{}{"a", []byte("b")}) {
+        t.Errorf("StripReply(keys) = %v", keys)
+    }
+    scan := n.StripReply("t1", "SCAN", []interface{}{"0", []interface{}{"t1:a"}})
+    if !reflect.DeepEqual(scan, []interface{}{"0", []interface{}{"a"}}) {
+        t.Errorf("StripReply(scan) = %v", scan)
+    }
+    pop := n.StripReply("t1", "blpop", []interface{}{"t1:l", "v"})
+    if !reflect.DeepEqual(pop, []interface{}{"l", "v"}) {
+        t.Errorf("StripReply(blpop) = %v", pop)
+    }
+}
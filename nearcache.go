@@ -0,0 +1,367 @@
+package main
+
+import (
+    "container/list"
+    "fmt"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/garyburd/redigo/redis"
+    "github.com/packing/clove/utils"
+)
+
+const nearCacheInvalidateChannel = "__redis__:invalidate"
+
+//可以由近端缓存直接应答的只读命令, 命令的第一个参数必须是key
+var nearCacheReadCommands = map[string]bool{
+    REDIS_COMMAND_GET:       true,
+    REDIS_COMMAND_STRLEN:    true,
+    REDIS_COMMAND_HGET:      true,
+    REDIS_COMMAND_HMGET:     true,
+    REDIS_COMMAND_HGETALL:   true,
+    REDIS_COMMAND_HEXISTS:   true,
+    REDIS_COMMAND_HKEYS:     true,
+    REDIS_COMMAND_HVALS:     true,
+    REDIS_COMMAND_HLEN:      true,
+    REDIS_COMMAND_LLEN:      true,
+    REDIS_COMMAND_LINDEX:    true,
+    REDIS_COMMAND_LRANGE:    true,
+    REDIS_COMMAND_SCARD:     true,
+    REDIS_COMMAND_SISMEMBER: true,
+    REDIS_COMMAND_SMEMBERS:  true,
+    REDIS_COMMAND_ZCARD:     true,
+    REDIS_COMMAND_ZCOUNT:    true,
+    REDIS_COMMAND_ZRANGE:    true,
+    REDIS_COMMAND_ZRANK:     true,
+    REDIS_COMMAND_ZREVRANK:  true,
+    REDIS_COMMAND_ZSCORE:    true,
+}
+
+type nearCacheEntry struct {
+    id     string
+    key    string
+    value  interface{}
+    stored time.Time
+}
+
+//NearCacheRedis 在真实Redis之前加一层进程内的LRU缓存.
+//写操作直接写入Redis并使本地副本失效, 其他客户端造成的修改通过 CLIENT TRACKING 的失效通知同步.
+//缓存项的最长存活时间由 maxStale 限定, 即使失效通知丢失也不会无限期地返回旧数据.
+type NearCacheRedis struct {
+    backend     *Redis
+    config      RedisConfig
+    capacity    int
+    maxStale    time.Duration
+    lru         *list.List
+    entries     map[string]*list.Element
+    keyIndex    map[string]map[string]bool
+    invalidated map[string]uint64
+    seq         uint64
+    floorSeq    uint64
+    trackingId  int64
+    mutex       sync.Mutex
+    stats       *cacheStats
+}
+
+func (r *NearCacheRedis) InitPool(config RedisConfig) {
+    config = withoutReplicas(config, "近端缓存")
+    r.config = config
+    r.capacity = config.NearCache.Size
+    if r.capacity <= 0 {
+        r.capacity = 10000
+    }
+    stale, err := time.ParseDuration(config.NearCache.MaxStale)
+    if err != nil {
+        if config.NearCache.MaxStale != "" {
+            utils.LogWarn("redis配置节中近端缓存最长陈旧时间maxStale的配置值可能有误")
+        }
+        stale = time.Second * 5
+    }
+    r.maxStale = stale
+    r.lru = list.New()
+    r.entries = make(map[string]*list.Element)
+    r.keyIndex = make(map[string]map[string]bool)
+    r.invalidated = make(map[string]uint64)
+    r.stats = createCacheStats()
+
+    r.backend = new(Redis)
+    r.backend.InitPool(config)
+
+    go r.trackInvalidations()
+    utils.LogInfo("初始化Redis近端缓存成功. 容量: %d, 最长陈旧时间: %s", r.capacity, r.maxStale)
+}
+
+func (r *NearCacheRedis) OpenConn(key uint64, owner string) bool {
+    return r.backend.OpenConn(key, owner)
+}
+
+func (r *NearCacheRedis) CloseConn(key uint64) {
+    r.backend.CloseConn(key)
+}
+
+func (r *NearCacheRedis) CloseOwnerConns(owner string) {
+    r.backend.CloseOwnerConns(owner)
+}
+
+func (r *NearCacheRedis) Do(cmd string, args ...interface{}) (interface{}, error) {
+    lcmd := strings.ToLower(cmd)
+    if lcmd == REDIS_COMMAND_INFO {
+        return r.info(cmd, args...)
+    }
+    if !nearCacheReadCommands[lcmd] || len(args) == 0 {
+        ret, err := r.backend.Do(cmd, args...)
+        r.invalidateArgs(lcmd, args)
+        return ret, err
+    }
+
+    key := redisArgString(args[0])
+    id := nearCacheEntryId(lcmd, args)
+    ret, ok := r.lookup(id)
+    if ok {
+        return ret, nil
+    }
+
+    tracking, startSeq := r.snapshot()
+    ret, err := r.backend.Do(cmd, args...)
+    if err == nil && tracking {
+        r.store(id, key, ret, startSeq)
+    }
+    return ret, err
+}
+
+func (r *NearCacheRedis) Send(key uint64, owner string, cmd string, args ...interface{}) error {
+    lcmd := strings.ToLower(cmd)
+    if !nearCacheReadCommands[lcmd] {
+        r.invalidateArgs(lcmd, args)
+    }
+    return r.backend.Send(key, owner, cmd, args...)
+}
+
+func (r *NearCacheRedis) Flush(key uint64, owner string) error {
+    return r.backend.Flush(key, owner)
+}
+
+func (r *NearCacheRedis) Receive(key uint64, owner string) (interface{}, error) {
+    return r.backend.Receive(key, owner)
+}
+
+//info 在Redis的 INFO 结果之后附加近端缓存自身的统计
+func (r *NearCacheRedis) info(cmd string, args ...interface{}) (interface{}, error) {
+    ret, err := redis.String(r.backend.Do(cmd, args...))
+    if err != nil {
+        return nil, err
+    }
+    s := r.stats
+    r.mutex.Lock()
+    entries := r.lru.Len()
+    r.mutex.Unlock()
+    var b strings.Builder
+    b.WriteString(ret)
+    b.WriteString("# Nearcache\r\n")
+    fmt.Fprintf(&b, "nearcache_entries:%d\r\n", entries)
+    fmt.Fprintf(&b, "nearcache_capacity:%d\r\n", r.capacity)
+    fmt.Fprintf(&b, "nearcache_hits:%d\r\n", atomic.LoadInt64(&s.hits))
+    fmt.Fprintf(&b, "nearcache_misses:%d\r\n", atomic.LoadInt64(&s.misses))
+    fmt.Fprintf(&b, "nearcache_expired:%d\r\n", atomic.LoadInt64(&s.expired))
+    fmt.Fprintf(&b, "nearcache_evicted:%d\r\n", atomic.LoadInt64(&s.evicted))
+    b.WriteString("\r\n")
+    return b.String(), nil
+}
+
+func nearCacheEntryId(cmd string, args []interface{}) string {
+    var b strings.Builder
+    b.WriteString(cmd)
+    for _, arg := range args {
+        b.WriteByte(0)
+        b.WriteString(fmt.Sprint(arg))
+    }
+    return b.String()
+}
+
+func (r *NearCacheRedis) snapshot() (bool, uint64) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    return atomic.LoadInt64(&r.trackingId) != 0, r.seq
+}
+
+func (r *NearCacheRedis) lookup(id string) (interface{}, bool) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    e, ok := r.entries[id]
+    if !ok {
+        r.stats.miss()
+        return nil, false
+    }
+    entry := e.Value.(*nearCacheEntry)
+    if time.Since(entry.stored) > r.maxStale {
+        r.removeElement(e)
+        r.stats.expire()
+        r.stats.miss()
+        return nil, false
+    }
+    r.lru.MoveToFront(e)
+    r.stats.hit()
+    return entry.value, true
+}
+
+//startSeq 之后如果该key已经失效过, 则本次读取到的数据可能已陈旧, 不再写入缓存
+func (r *NearCacheRedis) store(id string, key string, value interface{}, startSeq uint64) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    if startSeq < r.floorSeq || r.invalidated[key] > startSeq {
+        return
+    }
+    e, ok := r.entries[id]
+    if ok {
+        entry := e.Value.(*nearCacheEntry)
+        entry.value = value
+        entry.stored = time.Now()
+        r.lru.MoveToFront(e)
+        return
+    }
+    entry := &nearCacheEntry{id: id, key: key, value: value, stored: time.Now()}
+    r.entries[id] = r.lru.PushFront(entry)
+    ids, ok := r.keyIndex[key]
+    if !ok {
+        ids = make(map[string]bool)
+        r.keyIndex[key] = ids
+    }
+    ids[id] = true
+
+    for r.lru.Len() > r.capacity {
+        r.removeElement(r.lru.Back())
+        r.stats.evict()
+    }
+}
+
+func (r *NearCacheRedis) removeElement(e *list.Element) {
+    entry := e.Value.(*nearCacheEntry)
+    r.lru.Remove(e)
+    delete(r.entries, entry.id)
+    ids, ok := r.keyIndex[entry.key]
+    if ok {
+        delete(ids, entry.id)
+        if len(ids) == 0 {
+            delete(r.keyIndex, entry.key)
+        }
+    }
+}
+
+//invalidateArgs 使命令参数中的key失效, 值参数不参与. 无法确定会写入哪些key的命令使全部缓存失效
+func (r *NearCacheRedis) invalidateArgs(cmd string, args []interface{}) {
+    if redisKeysUnknown(cmd, args) {
+        r.invalidateAll()
+        return
+    }
+    keys := redisCommandKeys(cmd, args)
+    if len(keys) > 0 {
+        r.invalidate(keys...)
+    }
+}
+
+func (r *NearCacheRedis) invalidate(keys ...string) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.seq += 1
+    for _, key := range keys {
+        r.invalidated[key] = r.seq
+        ids, ok := r.keyIndex[key]
+        if !ok {
+            continue
+        }
+        for id := range ids {
+            e, ok := r.entries[id]
+            if ok {
+                r.lru.Remove(e)
+                delete(r.entries, id)
+            }
+        }
+        delete(r.keyIndex, key)
+    }
+    //失效记录只需要覆盖正在进行中的读取, 过多时整体作废即可
+    if len(r.invalidated) > r.capacity {
+        r.invalidated = make(map[string]uint64)
+        r.floorSeq = r.seq
+    }
+}
+
+func (r *NearCacheRedis) invalidateAll() {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.seq += 1
+    r.floorSeq = r.seq
+    r.lru.Init()
+    r.entries = make(map[string]*list.Element)
+    r.keyIndex = make(map[string]map[string]bool)
+    r.invalidated = make(map[string]uint64)
+}
+
+//trackingDial 新建的连接开启 CLIENT TRACKING, 失效通知重定向到 id 对应的通知连接
+func trackingDial(id int64) func(redis.Conn) error {
+    return func(c redis.Conn) error {
+        _, err := c.Do("CLIENT", "TRACKING", "ON", "REDIRECT", id)
+        return err
+    }
+}
+
+//维护接收失效通知的专用连接, 断开后清空缓存并重建连接池, 使新连接重定向到新的通知连接
+func (r *NearCacheRedis) trackInvalidations() {
+    for {
+        err := r.receiveInvalidations()
+        atomic.StoreInt64(&r.trackingId, 0)
+        r.invalidateAll()
+        if err != nil {
+            utils.LogError("Redis近端缓存失效通知连接中断: %s", err.Error())
+        }
+        time.Sleep(time.Second)
+    }
+}
+
+func (r *NearCacheRedis) receiveInvalidations() error {
+    //通知连接长时间阻塞在读取上, 不受 readTimeout 限制
+    c, err := dialRedis(r.config.Addr, r.config, redis.DialReadTimeout(0))
+    if err != nil {
+        return err
+    }
+    defer c.Close()
+
+    id, err := redis.Int64(c.Do("CLIENT", "ID"))
+    if err != nil {
+        return err
+    }
+    _, err = c.Do("SUBSCRIBE", nearCacheInvalidateChannel)
+    if err != nil {
+        return err
+    }
+
+    //先换上开启了跟踪的连接池再允许写入缓存, 保证 Do 在看到 trackingId 之后取到的一定是新池中的连接
+    r.backend.resetPool(createRedisPool(r.config.Addr, r.config, trackingDial(id)))
+    r.invalidateAll()
+    atomic.StoreInt64(&r.trackingId, id)
+    utils.LogInfo("Redis近端缓存失效通知已就绪. client id: %d", id)
+
+    for {
+        reply, err := redis.Values(c.Receive())
+        if err != nil {
+            return err
+        }
+        if len(reply) < 3 {
+            continue
+        }
+        kind, _ := redis.String(reply[0], nil)
+        if kind != "message" {
+            continue
+        }
+        if reply[2] == nil {
+            //FLUSHALL/FLUSHDB 时通知内容为空
+            r.invalidateAll()
+            continue
+        }
+        keys, err := redis.Strings(reply[2], nil)
+        if err == nil {
+            r.invalidate(keys...)
+        }
+    }
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "sync"
+    "sync/atomic"
+
+    "github.com/packing/clove/messages"
+    "github.com/packing/clove/utils"
+)
+
+type commandRules struct {
+    allow   map[string]bool
+    deny    map[string]bool
+    maxArgs map[string]int
+}
+
+//CommandPolicy 在命令发往Redis(或本地缓存)之前按配置检查是否放行.
+//规则既可以写命令名(如 "keys"), 也可以写命令加子命令(如 "config set").
+//检查顺序: 客户端deny -> 客户端allow(命中则不再检查全局名单) -> 全局deny -> 全局allow(非空时为白名单),
+//最后检查参数个数上限, 客户端的上限优先于全局上限.
+//EVAL/EVALSHA/FCALL 执行的脚本内部调用的命令不经过检查, 需要限制时应把这些命令本身加入deny
+type CommandPolicy struct {
+    global   commandRules
+    clients  map[string]commandRules
+    rejected int64
+    counts   map[string]int64
+    mutex    sync.Mutex
+}
+
+func createCommandRules(allow []string, deny []string, maxArgs map[string]int) commandRules {
+    rules := commandRules{allow: make(map[string]bool), deny: make(map[string]bool), maxArgs: make(map[string]int)}
+    for _, c := range allow {
+        rules.allow[strings.ToLower(c)] = true
+    }
+    for _, c := range deny {
+        rules.deny[strings.ToLower(c)] = true
+    }
+    for c, n := range maxArgs {
+        rules.maxArgs[strings.ToLower(c)] = n
+    }
+    return rules
+}
+
+func CreateCommandPolicy(config PolicyConfig) *CommandPolicy {
+    p := new(CommandPolicy)
+    p.global = createCommandRules(config.Allow, config.Deny, config.MaxArgs)
+    p.clients = make(map[string]commandRules)
+    for client, rc := range config.Clients {
+        p.clients[client] = createCommandRules(rc.Allow, rc.Deny, rc.MaxArgs)
+    }
+    p.counts = make(map[string]int64)
+    return p
+}
+
+//messageClient 返回用于匹配客户端规则的标识: unix 地址, 或 TCP 连接的对端主机
+func messageClient(msg *messages.Message) string {
+    if msg.GetUnixSource() != "" {
+        return msg.GetUnixSource()
+    }
+    if msg.GetController() != nil {
+        source := msg.GetController().GetSource()
+        i := strings.LastIndexByte(source, ':')
+        if i > 0 {
+            return source[:i]
+        }
+        return source
+    }
+    return ""
+}
+
+//match 返回规则表中是否包含命令本身或 "命令 子命令"
+func (rules commandRules) match(list map[string]bool, cmd string, sub string) bool {
+    return list[cmd] || (sub != "" && list[cmd+" "+sub])
+}
+
+func (rules commandRules) argLimit(cmd string, sub string) (int, bool) {
+    if sub != "" {
+        n, ok := rules.maxArgs[cmd+" "+sub]
+        if ok {
+            return n, true
+        }
+    }
+    n, ok := rules.maxArgs[cmd]
+    return n, ok
+}
+
+//Check 检查命令是否允许执行, 不允许时返回的错误直接作为应答发给客户端
+func (p *CommandPolicy) Check(client string, cmd string, args []interface{}) error {
+    if p == nil {
+        return nil
+    }
+    cmd = strings.ToLower(cmd)
+    sub := ""
+    if len(args) > 0 {
+        sub = strings.ToLower(redisArgString(args[0]))
+    }
+
+    rules, hasClient := p.clients[client]
+    allowed := true
+    decided := false
+    if hasClient {
+        if rules.match(rules.deny, cmd, sub) {
+            allowed, decided = false, true
+        } else if rules.match(rules.allow, cmd, sub) {
+            allowed, decided = true, true
+        }
+    }
+    if !decided {
+        if p.global.match(p.global.deny, cmd, sub) {
+            allowed = false
+        } else if len(p.global.allow) > 0 {
+            allowed = p.global.match(p.global.allow, cmd, sub)
+        }
+    }
+    if !allowed {
+        return p.reject(client, cmd, "NOPERM command '%s' is not allowed", cmd)
+    }
+
+    limit, ok := 0, false
+    if hasClient {
+        limit, ok = rules.argLimit(cmd, sub)
+    }
+    if !ok {
+        limit, ok = p.global.argLimit(cmd, sub)
+    }
+    if ok && len(args) > limit {
+        return p.reject(client, cmd, "NOPERM command '%s' has %d arguments, the limit is %d", cmd, len(args), limit)
+    }
+    return nil
+}
+
+func (p *CommandPolicy) reject(client string, cmd string, format string, a ...interface{}) error {
+    total := atomic.AddInt64(&p.rejected, 1)
+    p.mutex.Lock()
+    p.counts[cmd] += 1
+    p.mutex.Unlock()
+    utils.LogWarn("拒绝客户端 %s 的Redis命令 %s, 累计拒绝 %d 次", client, cmd, total)
+    return fmt.Errorf(format, a...)
+}
+
+//Metrics 以 expvar 的形式公开拒绝次数
+func (p *CommandPolicy) Metrics() interface{} {
+    total, counts := p.Rejected()
+    return map[string]interface{}{
+        "rejected":          total,
+        "rejected_commands": counts,
+    }
+}
+
+//Rejected 返回被拒绝的命令总数以及各命令被拒绝的次数
+func (p *CommandPolicy) Rejected() (int64, map[string]int64) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    counts := make(map[string]int64, len(p.counts))
+    for cmd, n := range p.counts {
+        counts[cmd] = n
+    }
+    return atomic.LoadInt64(&p.rejected), counts
+}
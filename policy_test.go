@@ -0,0 +1,75 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestCommandPolicyCheck(t *testing.T) {
+    p := CreateCommandPolicy(PolicyConfig{
+        Deny:    []string{"FLUSHALL", "config set"},
+        MaxArgs: map[string]int{"mget": 3, "hmset": 5},
+        Clients: map[string]ClientPolicyConfig{
+            "/tmp/admin.sock": {Allow: []string{"flushall"}, MaxArgs: map[string]int{"mget": 10}},
+            "10.0.0.5":        {Deny: []string{"keys"}},
+        },
+    })
+    cases := []struct {
+        client  string
+        cmd     string
+        args    []interface{}
+        allowed bool
+    }{
+        {"", "get", []interface{}{"a"}, true},
+        //全局deny, 命令名不区分大小写
+        {"", "flushall", nil, false},
+        {"", "FlushAll", nil, false},
+        //按子命令拒绝
+        {"", "config", []interface{}{"SET", "maxmemory", "1"}, false},
+        {"", "config", []interface{}{"get", "maxmemory"}, true},
+        //客户端allow优先于全局deny
+        {"/tmp/admin.sock", "flushall", nil, true},
+        //客户端deny只对该客户端生效
+        {"10.0.0.5", "keys", []interface{}{"*"}, false},
+        {"", "keys", []interface{}{"*"}, true},
+        {"10.0.0.5", "flushall", nil, false},
+        //参数个数上限, 客户端的上限优先
+        {"", "mget", []interface{}{"a", "b", "c"}, true},
+        {"", "mget", []interface{}{"a", "b", "c", "d"}, false},
+        {"/tmp/admin.sock", "mget", []interface{}{"a", "b", "c", "d"}, true},
+        {"10.0.0.5", "mget", []interface{}{"a", "b", "c", "d"}, false},
+    }
+    rejected := int64(0)
+    for _, c := range cases {
+        err := p.Check(c.client, c.cmd, c.args)
+        if (err == nil) != c.allowed {
+            t.Errorf("Check(%q, %s %v) = %v, want allowed %v", c.client, c.cmd, c.args, err, c.allowed)
+        }
+        if err != nil {
+            rejected += 1
+        }
+    }
+    total, counts := p.Rejected()
+    if total != rejected || counts["flushall"] != 3 || counts["mget"] != 2 {
+        t.Errorf("Rejected() = %d, %v, want %d rejections", total, counts, rejected)
+    }
+}
+
+func TestCommandPolicyAllowList(t *testing.T) {
+    p := CreateCommandPolicy(PolicyConfig{Allow: []string{"get", "client list"}})
+    if p.Check("", "get", []interface{}{"a"}) != nil {
+        t.Error("get should be allowed")
+    }
+    if p.Check("", "set", []interface{}{"a", "1"}) == nil {
+        t.Error("set should not be allowed by a non-empty allow list")
+    }
+    if p.Check("", "client", []interface{}{"LIST"}) != nil {
+        t.Error("client list should be allowed")
+    }
+    if p.Check("", "client", []interface{}{"kill", "x"}) == nil {
+        t.Error("client kill should not be allowed")
+    }
+    var nilPolicy *CommandPolicy
+    if nilPolicy.Check("", "flushall", nil) != nil {
+        t.Error("a nil policy should allow everything")
+    }
+}
@@ -1,60 +1,120 @@
 package main
 
 import (
+    "os"
     "strings"
     "sync"
     "time"
 
     "github.com/garyburd/redigo/redis"
     "github.com/packing/clove/codecs"
+    "github.com/packing/clove/errors"
     "github.com/packing/clove/utils"
 )
 
 type IRedis interface {
     InitPool(config RedisConfig)
-    OpenConn(uint64) bool
+    OpenConn(uint64, string) bool
     CloseConn(uint64)
+    CloseOwnerConns(string)
     Do(string, ...interface{}) (interface{}, error)
-    Send(uint64, string, ...interface{}) error
-    Flush(uint64) error
-    Receive(uint64) (interface{}, error)
+    Send(uint64, string, string, ...interface{}) error
+    Flush(uint64, string) error
+    Receive(uint64, string) (interface{}, error)
+}
+
+var ErrorForkConnLimit = errors.Errorf("too many forked redis connections")
+
+//forkedConn 是以 ProtocolKeyKeyForRedis 为键独占的连接, 用于 Send/Flush/Receive 管道操作
+type forkedConn struct {
+    conn redis.Conn
+    owner string
+    lastUse time.Time
+    busy int
+    closing bool
+    pending []string
+    subscribed bool
 }
 
 type Redis struct {
     pool *redis.Pool
-    forkConns map[uint64] redis.Conn
+    forkConns map[uint64] *forkedConn
+    forkLimit int
+    forkIdle time.Duration
     mutex sync.Mutex
+    poolMutex sync.RWMutex
+    valueCodec bool
+    replicas []*redis.Pool
+    replicaAddrs []string
+    replicaNext uint64
+    closed chan struct{}
 }
 
 func(r *Redis) InitPool(config RedisConfig) {
-    r.forkConns = make(map[uint64] redis.Conn)
-    r.pool = new(redis.Pool)
-    r.pool.MaxIdle = config.Idle
-    r.pool.MaxActive = config.Active
+    r.initPool(config, createRedisPool(config.Addr, config, nil))
+}
+
+//initPool 以给定的连接池初始化, 连接池的拨号方式由调用者决定(例如通过 Sentinel 解析主节点)
+func(r *Redis) initPool(config RedisConfig, pool *redis.Pool) {
+    r.forkConns = make(map[uint64] *forkedConn)
+    r.closed = make(chan struct{})
+    r.forkLimit = config.ForkLimit
+    idle, err := time.ParseDuration(config.ForkIdleTime)
+    if err == nil {
+        r.forkIdle = idle
+    } else {
+        if config.ForkIdleTime != "" {
+            utils.LogWarn("redis配置节中独占连接空闲时长forkIdle的配置值可能有误")
+        }
+        r.forkIdle = time.Minute * 5
+    }
+    r.valueCodec = config.ValueCodec
+    r.pool = pool
+    if len(config.Replicas) > 0 {
+        r.setReplicas(config.Replicas, config)
+    }
+    go r.reapForkConns()
+    utils.LogInfo("初始化Redis连接池成功. 容量: %d / %d", r.pool.Stats().ActiveCount, r.pool.Stats().IdleCount)
+}
+
+func createRedisPool(addr string, config RedisConfig, onDial func(redis.Conn) error) *redis.Pool {
+    pool := new(redis.Pool)
+    pool.MaxIdle = config.Idle
+    pool.MaxActive = config.Active
     idle, err := time.ParseDuration(config.IdleTime)
-    if err != nil {
-        r.pool.IdleTimeout = idle
+    if err == nil {
+        pool.IdleTimeout = idle
+    } else if config.IdleTime != "" {
+        utils.LogWarn("redis配置节中空闲时长字段idle的配置值可能有误")
     }
     life, err := time.ParseDuration(config.LifeTime)
-    if err != nil {
-        r.pool.MaxConnLifetime = life
+    if err == nil {
+        pool.MaxConnLifetime = life
+    } else if config.LifeTime != "" {
+        utils.LogWarn("redis配置节中生存时长字段life的配置值可能有误")
     }
-    r.pool.Dial = func() (conn redis.Conn, e error) {
-        utils.LogInfo("Redis 连接至 %s", config.Addr)
-        var ops = make([]redis.DialOption, 0)
-
-        if config.Pwd != "" {
-            ops = append(ops, redis.DialPassword(config.Pwd))
-        }
-
-        if strings.Contains(config.Addr, ":") {
-            return redis.Dial("tcp", config.Addr, ops...)
-        } else {
-            return redis.Dial("unix", config.Addr, ops...)
+    _, err = time.ParseDuration(config.ConnectTimeout)
+    if err != nil && config.ConnectTimeout != "" {
+        utils.LogWarn("redis配置节中连接超时connectTimeout的配置值可能有误")
+    }
+    _, err = time.ParseDuration(config.ReadTimeout)
+    if err != nil && config.ReadTimeout != "" {
+        utils.LogWarn("redis配置节中读取超时readTimeout的配置值可能有误")
+    }
+    pool.Dial = func() (conn redis.Conn, e error) {
+        utils.LogInfo("Redis 连接至 %s", addr)
+        conn, e = dialRedis(addr, config)
+        if e == nil && onDial != nil {
+            e = onDial(conn)
+            if e != nil {
+                conn.Close()
+                conn = nil
+            }
         }
+        return conn, e
     }
 
-    r.pool.TestOnBorrow = func(c redis.Conn, t time.Time) error {
+    pool.TestOnBorrow = func(c redis.Conn, t time.Time) error {
         if time.Since(t) < time.Minute {
             return nil
         }
@@ -64,65 +124,352 @@ func(r *Redis) InitPool(config RedisConfig) {
         }
         return err
     }
-    utils.LogInfo("初始化Redis连接池成功. 容量: %d / %d", r.pool.Stats().ActiveCount, r.pool.Stats().IdleCount)
+    return pool
+}
+
+//redisTimeoutOptions 返回配置的连接与读取超时, 未配置或配置有误时不限制.
+//读取超时同样作用于 BLPOP 等阻塞命令, 需要大于客户端使用的阻塞时长
+func redisTimeoutOptions(config RedisConfig) []redis.DialOption {
+    ops := make([]redis.DialOption, 0)
+    connect, err := time.ParseDuration(config.ConnectTimeout)
+    if err == nil {
+        ops = append(ops, redis.DialConnectTimeout(connect))
+    }
+    read, err := time.ParseDuration(config.ReadTimeout)
+    if err == nil {
+        ops = append(ops, redis.DialReadTimeout(read))
+    }
+    return ops
+}
+
+//dialRedis 建立单条连接, extra 中的选项最后应用, 可以覆盖配置中的超时
+func dialRedis(addr string, config RedisConfig, extra ...redis.DialOption) (redis.Conn, error) {
+    var ops = redisTimeoutOptions(config)
+
+    if config.Pwd != "" && config.Username == "" {
+        ops = append(ops, redis.DialPassword(config.Pwd))
+    }
+
+    network := "unix"
+    if strings.Contains(addr, ":") {
+        network = "tcp"
+        tlsOps, err := redisTLSOptions(config.TLS)
+        if err != nil {
+            return nil, err
+        }
+        ops = append(ops, tlsOps...)
+    }
+    ops = append(ops, extra...)
+
+    c, err := redis.Dial(network, addr, ops...)
+    if err != nil || config.Username == "" {
+        return c, err
+    }
+    err = redisAuthACL(c, config.Username, config.Pwd)
+    if err != nil {
+        return nil, err
+    }
+    return c, nil
+}
+
+func(r *Redis) getPool() *redis.Pool {
+    r.poolMutex.RLock()
+    defer r.poolMutex.RUnlock()
+    return r.pool
+}
+
+//替换 Do 使用的连接池, 旧池中的连接在归还时随旧池一并关闭.
+//已经独占的管道连接不受影响, 由客户端继续使用直到 CloseConn 或被回收
+func(r *Redis) resetPool(pool *redis.Pool) {
+    r.poolMutex.Lock()
+    old := r.pool
+    r.pool = pool
+    r.poolMutex.Unlock()
+
+    if old != nil {
+        old.Close()
+    }
+}
+
+//Close 关闭连接池, 全部独占连接和副本连接池, 并停止回收协程. 用于移除不再使用的节点
+func(r *Redis) Close() {
+    close(r.closed)
+    r.mutex.Lock()
+    for key, fc := range r.forkConns {
+        r.closeFork(key, fc)
+    }
+    r.mutex.Unlock()
+
+    r.poolMutex.Lock()
+    pool := r.pool
+    replicas := r.replicas
+    r.replicas = nil
+    r.replicaAddrs = nil
+    r.poolMutex.Unlock()
+    pool.Close()
+    for _, p := range replicas {
+        p.Close()
+    }
+}
+
+//setReplicas 按地址列表重建只读副本连接池, 地址未变化时保留原有连接池
+func(r *Redis) setReplicas(addrs []string, config RedisConfig) {
+    r.poolMutex.Lock()
+    defer r.poolMutex.Unlock()
+    if strings.Join(addrs, ",") == strings.Join(r.replicaAddrs, ",") {
+        return
+    }
+    olds := make(map[string]*redis.Pool)
+    for i, addr := range r.replicaAddrs {
+        olds[addr] = r.replicas[i]
+    }
+    replicas := make([]*redis.Pool, len(addrs))
+    for i, addr := range addrs {
+        pool, ok := olds[addr]
+        if ok {
+            delete(olds, addr)
+        } else {
+            pool = createRedisPool(addr, config, nil)
+        }
+        replicas[i] = pool
+    }
+    for _, pool := range olds {
+        pool.Close()
+    }
+    r.replicas = replicas
+    r.replicaAddrs = addrs
+    utils.LogInfo("Redis只读副本已更新: %s", strings.Join(addrs, ","))
 }
 
 func(r *Redis) CloseConn(key uint64) {
     r.mutex.Lock()
     defer r.mutex.Unlock()
-    c, ok := r.forkConns[key]
+    fc, ok := r.forkConns[key]
     if ok {
-        c.Close()
-        delete(r.forkConns, key)
+        r.closeFork(key, fc)
     }
 }
 
-func (r *Redis) OpenConn(key uint64) bool {
-    return r.forkConn(key) != nil
+//closeFork 移除独占连接, 仍有命令在使用时推迟到 releaseFork 中关闭. 调用时需持有 r.mutex
+func(r *Redis) closeFork(key uint64, fc *forkedConn) {
+    delete(r.forkConns, key)
+    if fc.busy > 0 {
+        fc.closing = true
+        return
+    }
+    fc.conn.Close()
 }
 
-func(r *Redis) forkConn(key uint64) redis.Conn {
+//CloseOwnerConns 关闭某个客户端(TCP连接或unix地址)名下的全部独占连接, 在客户端断开时调用
+func(r *Redis) CloseOwnerConns(owner string) {
+    if owner == "" {
+        return
+    }
     r.mutex.Lock()
     defer r.mutex.Unlock()
-    c, ok := r.forkConns[key]
+    c := 0
+    for key, fc := range r.forkConns {
+        if fc.owner == owner {
+            r.closeFork(key, fc)
+            c += 1
+        }
+    }
+    if c > 0 {
+        utils.LogInfo("客户端 %s 已断开, 释放 %d 个Redis独占连接", owner, c)
+    }
+}
+
+func (r *Redis) OpenConn(key uint64, owner string) bool {
+    fc, err := r.acquireFork(key, owner)
+    if err != nil {
+        return false
+    }
+    r.releaseFork(fc)
+    return true
+}
+
+func(r *Redis) acquireFork(key uint64, owner string) (*forkedConn, error) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    fc, ok := r.forkConns[key]
     if !ok {
-        c = r.pool.Get()
-        r.forkConns[key] = c
+        if r.forkLimit > 0 && len(r.forkConns) >= r.forkLimit {
+            utils.LogWarn("Redis独占连接数已达上限 %d", r.forkLimit)
+            return nil, ErrorForkConnLimit
+        }
+        fc = &forkedConn{conn: r.getPool().Get()}
+        r.forkConns[key] = fc
+    }
+    if owner != "" {
+        fc.owner = owner
+    }
+    fc.lastUse = time.Now()
+    fc.busy += 1
+    return fc, nil
+}
+
+func(r *Redis) releaseFork(fc *forkedConn) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    fc.lastUse = time.Now()
+    fc.busy -= 1
+    if fc.closing && fc.busy == 0 {
+        fc.conn.Close()
+    }
+}
+
+//unixOwnerGone 判断unix客户端的地址文件是否已经不存在, unix客户端没有断开通知, 只能以此判断
+func unixOwnerGone(owner string) bool {
+    if !strings.HasPrefix(owner, unixOwnerPrefix) {
+        return false
+    }
+    _, err := os.Stat(strings.TrimPrefix(owner, unixOwnerPrefix))
+    return os.IsNotExist(err)
+}
+
+//定期回收长时间未使用的独占连接, 以及所属unix地址已不存在的连接
+func(r *Redis) reapForkConns() {
+    interval := r.forkIdle / 4
+    if interval < time.Second {
+        interval = time.Second
+    } else if interval > time.Second * 30 {
+        interval = time.Second * 30
+    }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+        case <-r.closed:
+            return
+        }
+        r.mutex.Lock()
+        for key, fc := range r.forkConns {
+            if fc.busy > 0 {
+                continue
+            }
+            reap := time.Since(fc.lastUse) > r.forkIdle || unixOwnerGone(fc.owner)
+            if reap {
+                fc.conn.Close()
+                delete(r.forkConns, key)
+                utils.LogInfo("回收Redis独占连接 %d, 所属 %s", key, fc.owner)
+            }
+        }
+        r.mutex.Unlock()
     }
-    return c
 }
 
 func(r *Redis) Do(cmd string, args ...interface{}) (interface{}, error) {
-    c := r.pool.Get()
+    encoded, err := r.encodeArgs(cmd, args)
+    if err != nil {
+        return nil, err
+    }
+    c := r.getPool().Get()
     defer c.Close()
 
-    ret, err := c.Do(cmd, args...)
+    ret, err := c.Do(cmd, encoded...)
 
-    return ret, err
+    return r.decodeReply(cmd, ret), err
 }
 
-func(r *Redis) Send(key uint64, cmd string, args ...interface{}) error {
-    c := r.forkConn(key)
-    err := c.Send(cmd, args...)
+func(r *Redis) Send(key uint64, owner string, cmd string, args ...interface{}) error {
+    fc, err := r.acquireFork(key, owner)
+    if err != nil {
+        return err
+    }
+    defer r.releaseFork(fc)
+    encoded, err := r.encodeArgs(cmd, args)
+    if err != nil {
+        return err
+    }
+    err = fc.conn.Send(cmd, encoded...)
+    if err == nil && r.valueCodec {
+        r.mutex.Lock()
+        //订阅类命令的应答都以推送的形式到达, 不占用待解码队列
+        if redisPubSubCommands[strings.ToLower(cmd)] {
+            fc.subscribed = true
+        } else {
+            fc.pending = append(fc.pending, cmd)
+        }
+        r.mutex.Unlock()
+    }
     return err
 }
 
-func(r *Redis) Flush(key uint64) error {
-    c := r.forkConn(key)
-    return c.Flush()
+func(r *Redis) Flush(key uint64, owner string) error {
+    fc, err := r.acquireFork(key, owner)
+    if err != nil {
+        return err
+    }
+    defer r.releaseFork(fc)
+    return fc.conn.Flush()
 }
 
-func(r *Redis) Receive(key uint64) (interface{}, error) {
-    c := r.forkConn(key)
-    return c.Receive()
+func(r *Redis) Receive(key uint64, owner string) (interface{}, error) {
+    fc, err := r.acquireFork(key, owner)
+    if err != nil {
+        return nil, err
+    }
+    defer r.releaseFork(fc)
+    ret, err := fc.conn.Receive()
+    if !r.valueCodec {
+        return ret, err
+    }
+    cmd := ""
+    r.mutex.Lock()
+    if fc.subscribed && isPubSubPush(ret) {
+        r.mutex.Unlock()
+        return ret, err
+    }
+    if len(fc.pending) > 0 {
+        cmd = fc.pending[0]
+        fc.pending = fc.pending[1:]
+    }
+    r.mutex.Unlock()
+    return r.decodeReply(cmd, ret), err
 }
 
+var redisPubSubCommands = map[string]bool{
+    "subscribe":    true,
+    "psubscribe":   true,
+    "ssubscribe":   true,
+    "unsubscribe":  true,
+    "punsubscribe": true,
+    "sunsubscribe": true,
+}
+
+var redisPubSubPushKinds = map[string]bool{
+    "message":      true,
+    "pmessage":     true,
+    "smessage":     true,
+    "subscribe":    true,
+    "psubscribe":   true,
+    "ssubscribe":   true,
+    "unsubscribe":  true,
+    "punsubscribe": true,
+    "sunsubscribe": true,
+}
+
+//isPubSubPush 判断应答是否为订阅连接上主动推送的消息或订阅确认
+func isPubSubPush(reply interface{}) bool {
+    vs, ok := reply.([]interface{})
+    if !ok || len(vs) < 3 {
+        return false
+    }
+    kind, ok := vs[0].([]byte)
+    return ok && redisPubSubPushKinds[string(kind)]
+}
+
+//unPackData 还原由 packData 写入的值. 只有以标记字节开头的值才会被解码,
+//其余数据(整数, 或由其他客户端写入的原始字符串)原样以字符串返回
 func(r *Redis) unPackData(v interface{}) interface{} {
     var b []byte = nil
     switch v.(type) {
     case []byte:
         b = v.([]byte)
     case string:
+        b = []byte(v.(string))
+    default:
         return v
     }
 
@@ -130,26 +477,30 @@ func(r *Redis) unPackData(v interface{}) interface{} {
         return nil
     }
 
-    if b[0] == 0 {
+    switch b[0] {
+    case redisCodecString:
         return string(b[1:])
+    case redisCodecIMv2:
+        err, data, remain := codecs.CodecIMv2.Decoder.Decode(b[1:])
+        if err == nil && len(remain) == 0 {
+            return data
+        }
     }
-
-    err, data, _ := codecs.CodecIMv2.Decoder.Decode(b)
-    if err == nil {
-        return data
-    }
-    return nil
+    return string(b)
 }
 
-func(r *Redis) packData(v interface{}) string {
-    s, ok := v.(string)
-    if ok {
-        bs := []byte(s)
-        return string(append([]byte{0}, bs...))
+//packData 编码写入Redis的值. 整数保持原样以便 INCR 等命令继续可用
+func(r *Redis) packData(v interface{}) interface{} {
+    switch v.(type) {
+    case string:
+        bs := []byte(v.(string))
+        return string(append([]byte{redisCodecString}, bs...))
+    case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+        return v
     }
     err, data := codecs.CodecIMv2.Encoder.Encode(&v)
     if err == nil {
-        return string(data)
+        return string(append([]byte{redisCodecIMv2}, data...))
     }
     return ""
-}
\ No newline at end of file
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/garyburd/redigo/redis"
+    "github.com/packing/clove/errors"
+    "github.com/packing/clove/utils"
+)
+
+const (
+    breakerClosed = iota
+    breakerOpen
+    breakerHalfOpen
+    breakerReplaying
+)
+
+const (
+    breakerReconcileReplay  = "replay"
+    breakerReconcileDiscard = "discard"
+)
+
+var ErrorCircuitOpen = errors.Errorf("redis circuit breaker is open")
+
+type breakerWrite struct {
+    cmd  string
+    args []interface{}
+}
+
+//BreakerRedis 在Redis后端外包一层熔断器. 连续的连接层错误达到阈值后熔断, 熔断期间命令立即失败
+//或降级到本地的 LocalFastRedis; 熔断时长结束后进入半开状态放行少量探测请求, 探测成功后
+//按配置把降级期间的写命令回放到Redis或直接丢弃, 回放期间的请求仍由降级缓存处理, 回放完成后才恢复正常.
+//降级缓存在每次熔断时从空开始, 熔断期间读不到熔断前已写入Redis的数据, 只能读到降级期间自身写入的内容
+type BreakerRedis struct {
+    backend     IRedis
+    fallback    *LocalFastRedis
+    threshold   int
+    openTime    time.Duration
+    probes      int
+    reconcile   string
+    journalSize int
+    state       int
+    failures    int
+    probing     int
+    openedAt    time.Time
+    journal     []breakerWrite
+    journalLost bool
+    mutex       sync.Mutex
+    replayMutex sync.Mutex
+}
+
+func (r *BreakerRedis) InitPool(config RedisConfig) {
+    bc := config.Breaker
+    r.threshold = bc.Failures
+    if r.threshold <= 0 {
+        r.threshold = 5
+    }
+    r.probes = bc.Probes
+    if r.probes <= 0 {
+        r.probes = 1
+    }
+    r.journalSize = bc.JournalSize
+    if r.journalSize <= 0 {
+        r.journalSize = 100000
+    }
+    openTime, err := time.ParseDuration(bc.OpenTime)
+    if err == nil {
+        r.openTime = openTime
+    } else {
+        if bc.OpenTime != "" {
+            utils.LogWarn("redis配置节中熔断时长openTime的配置值可能有误")
+        }
+        r.openTime = time.Second * 10
+    }
+    r.reconcile = bc.Reconcile
+    if r.reconcile != breakerReconcileDiscard {
+        r.reconcile = breakerReconcileReplay
+    }
+    if bc.Fallback {
+        r.fallback = r.createFallback()
+    }
+    r.backend.InitPool(config)
+    utils.LogInfo("Redis熔断器已启用. 阈值: %d, 熔断时长: %s, 降级: %v", r.threshold, r.openTime, bc.Fallback)
+}
+
+func (r *BreakerRedis) createFallback() *LocalFastRedis {
+    fallback := new(LocalFastRedis)
+    fallback.InitPool(RedisConfig{})
+    return fallback
+}
+
+//isBreakerFailure 只有连接层面的错误计入失败, Redis返回的命令错误说明服务本身可用
+func isBreakerFailure(err error) bool {
+    if err == nil || err == ErrorForkConnLimit || err == ErrorCrossSlot {
+        return false
+    }
+    _, ok := err.(redis.Error)
+    return !ok
+}
+
+//allow 判断请求能否发往Redis, probe 表示该请求是半开状态下的探测请求
+func (r *BreakerRedis) allow() (allowed bool, probe bool) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    switch r.state {
+    case breakerClosed:
+        return true, false
+    case breakerReplaying:
+        return false, false
+    case breakerOpen:
+        if time.Since(r.openedAt) < r.openTime {
+            return false, false
+        }
+        r.state = breakerHalfOpen
+        r.probing = 0
+        utils.LogInfo("Redis熔断器进入半开状态")
+    }
+    if r.probing < r.probes {
+        r.probing += 1
+        return true, true
+    }
+    return false, false
+}
+
+func (r *BreakerRedis) report(err error, probe bool) {
+    failure := isBreakerFailure(err)
+    r.mutex.Lock()
+    if probe {
+        r.probing -= 1
+        if r.state != breakerHalfOpen {
+            r.mutex.Unlock()
+            return
+        }
+        if failure {
+            r.trip()
+            r.mutex.Unlock()
+            return
+        }
+        //回放期间不再放行请求, 避免新的写入与回放的写命令乱序. 回放在单独的协程中进行, 探测请求本身立即返回
+        r.state = breakerReplaying
+        r.mutex.Unlock()
+        go r.recover()
+        return
+    }
+    defer r.mutex.Unlock()
+    if r.state != breakerClosed {
+        return
+    }
+    if !failure {
+        r.failures = 0
+        return
+    }
+    r.failures += 1
+    if r.failures >= r.threshold {
+        r.trip()
+    }
+}
+
+//trip 进入熔断状态, 调用方需持有 mutex
+func (r *BreakerRedis) trip() {
+    if r.state == breakerClosed {
+        utils.LogWarn("Redis连续失败 %d 次, 熔断器打开", r.failures)
+    } else {
+        utils.LogWarn("Redis探测失败, 熔断器重新打开")
+    }
+    r.state = breakerOpen
+    r.openedAt = time.Now()
+    r.failures = 0
+}
+
+//recover 探测成功后先处理降级期间的写命令, 日志清空后才关闭熔断器, 保证回放期间新的写入不会丢失
+func (r *BreakerRedis) recover() {
+    r.replayMutex.Lock()
+    defer r.replayMutex.Unlock()
+    for {
+        r.mutex.Lock()
+        if r.state != breakerReplaying {
+            r.mutex.Unlock()
+            return
+        }
+        journal := r.journal
+        r.journal = nil
+        if len(journal) == 0 || r.reconcile == breakerReconcileDiscard || r.journalLost {
+            if len(journal) > 0 || r.journalLost {
+                utils.LogWarn("Redis已恢复, 丢弃降级期间的 %d 条写命令", len(journal))
+            }
+            r.journal = nil
+            r.journalLost = false
+            r.state = breakerClosed
+            r.failures = 0
+            if r.fallback != nil {
+                r.fallback = r.createFallback()
+            }
+            r.mutex.Unlock()
+            utils.LogInfo("Redis已恢复, 熔断器关闭")
+            return
+        }
+        r.mutex.Unlock()
+
+        utils.LogInfo("Redis已恢复, 回放降级期间的 %d 条写命令", len(journal))
+        for i, w := range journal {
+            _, err := r.backend.Do(w.cmd, w.args...)
+            if err == nil {
+                continue
+            }
+            if isBreakerFailure(err) {
+                r.mutex.Lock()
+                r.journal = append(journal[i:], r.journal...)
+                r.trip()
+                r.mutex.Unlock()
+                return
+            }
+            utils.LogError("回放写命令 %s 失败: %s", w.cmd, err.Error())
+        }
+    }
+}
+
+//degrade 熔断期间的处理: 未配置降级时直接失败, 否则在本地缓存执行并记录写命令
+func (r *BreakerRedis) degrade(cmd string, args []interface{}) (interface{}, error) {
+    r.mutex.Lock()
+    fallback := r.fallback
+    r.mutex.Unlock()
+    if fallback == nil {
+        return nil, ErrorCircuitOpen
+    }
+    lcmd := strings.ToLower(cmd)
+    ret, err := fallback.Do(lcmd, args...)
+    if err != nil || !localWriteCommands[lcmd] || r.reconcile == breakerReconcileDiscard {
+        return ret, err
+    }
+    lcmd, args = rewriteForReplication(lcmd, args, ret)
+    r.mutex.Lock()
+    if len(r.journal) < r.journalSize {
+        r.journal = append(r.journal, breakerWrite{cmd: lcmd, args: args})
+    } else if !r.journalLost {
+        r.journalLost = true
+        utils.LogWarn("Redis降级写日志已满 %d 条, 恢复后将丢弃降级期间的数据", r.journalSize)
+    }
+    r.mutex.Unlock()
+    return ret, err
+}
+
+func (r *BreakerRedis) Do(cmd string, args ...interface{}) (interface{}, error) {
+    allowed, probe := r.allow()
+    if !allowed {
+        return r.degrade(cmd, args)
+    }
+    ret, err := r.backend.Do(cmd, args...)
+    r.report(err, probe)
+    return ret, err
+}
+
+//DoReplica 熔断状态与主节点共用, 副本失败时后端已经回退到主节点
+func (r *BreakerRedis) DoReplica(cmd string, args ...interface{}) (interface{}, error) {
+    replica, ok := r.backend.(IReplicaRedis)
+    if !ok {
+        return r.Do(cmd, args...)
+    }
+    allowed, probe := r.allow()
+    if !allowed {
+        return r.degrade(cmd, args)
+    }
+    ret, err := replica.DoReplica(cmd, args...)
+    r.report(err, probe)
+    return ret, err
+}
+
+//熔断期间不提供独占连接, 管道命令直接失败
+func (r *BreakerRedis) OpenConn(key uint64, owner string) bool {
+    allowed, probe := r.allow()
+    if !allowed {
+        return false
+    }
+    ok := r.backend.OpenConn(key, owner)
+    if probe {
+        r.report(nil, probe)
+    }
+    return ok
+}
+
+func (r *BreakerRedis) CloseConn(key uint64) {
+    r.backend.CloseConn(key)
+}
+
+func (r *BreakerRedis) CloseOwnerConns(owner string) {
+    r.backend.CloseOwnerConns(owner)
+}
+
+func (r *BreakerRedis) Send(key uint64, owner string, cmd string, args ...interface{}) error {
+    allowed, probe := r.allow()
+    if !allowed {
+        return ErrorCircuitOpen
+    }
+    err := r.backend.Send(key, owner, cmd, args...)
+    r.report(err, probe)
+    return err
+}
+
+func (r *BreakerRedis) Flush(key uint64, owner string) error {
+    allowed, probe := r.allow()
+    if !allowed {
+        return ErrorCircuitOpen
+    }
+    err := r.backend.Flush(key, owner)
+    r.report(err, probe)
+    return err
+}
+
+func (r *BreakerRedis) Receive(key uint64, owner string) (interface{}, error) {
+    allowed, probe := r.allow()
+    if !allowed {
+        return nil, ErrorCircuitOpen
+    }
+    ret, err := r.backend.Receive(key, owner)
+    r.report(err, probe)
+    return ret, err
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/garyburd/redigo/redis"
+    "github.com/packing/clove/errors"
+    "github.com/packing/clove/utils"
+)
+
+const (
+    clusterMaxRedirects    = 5
+    clusterRefreshInterval = time.Second * 30
+    clusterRefreshTimeout  = time.Second * 3
+)
+
+var ErrorClusterNoNode = errors.Errorf("CLUSTERDOWN no reachable node for this slot")
+
+//ClusterRedis 以 Redis Cluster 协议访问集群. 启动时通过 CLUSTER SLOTS 获取槽位分布,
+//每个主节点维护独立的连接池, 遇到 MOVED/ASK 时跟随重定向, 并在拓扑变化后重新拉取槽位表.
+//nodes 配置为种子节点列表, 可以指向本机以多个进程启动的集群进行测试, 见 scripts/redis-cluster.sh
+type ClusterRedis struct {
+    redisPipelines
+    config     RedisConfig
+    seeds      []string
+    slots      [redisSlotCount]string
+    nodes      map[string]*Redis
+    refreshing int32
+    mutex      sync.RWMutex
+}
+
+func (r *ClusterRedis) InitPool(config RedisConfig) {
+    config = withoutReplicas(config, "集群")
+    r.redisPipelines.init()
+    r.config = config
+    r.seeds = config.Nodes
+    r.nodes = make(map[string]*Redis)
+    err := r.refreshSlots()
+    if err != nil {
+        utils.LogError("获取Redis集群槽位表失败: %s", err.Error())
+    }
+    go func() {
+        for range time.Tick(clusterRefreshInterval) {
+            r.triggerRefresh()
+        }
+    }()
+    utils.LogInfo("初始化Redis集群成功. 种子节点: %s", strings.Join(r.seeds, ","))
+}
+
+func (r *ClusterRedis) getNode(addr string) *Redis {
+    r.mutex.RLock()
+    node, ok := r.nodes[addr]
+    r.mutex.RUnlock()
+    if ok {
+        return node
+    }
+
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    node, ok = r.nodes[addr]
+    if !ok {
+        nodeConfig := r.config
+        nodeConfig.Addr = addr
+        nodeConfig.Replicas = nil
+        node = new(Redis)
+        node.InitPool(nodeConfig)
+        r.nodes[addr] = node
+    }
+    return node
+}
+
+func (r *ClusterRedis) allNodes() []*Redis {
+    r.mutex.RLock()
+    defer r.mutex.RUnlock()
+    nodes := make([]*Redis, 0, len(r.nodes))
+    for _, node := range r.nodes {
+        nodes = append(nodes, node)
+    }
+    return nodes
+}
+
+//masterNodes 返回当前槽位表中的全部主节点
+func (r *ClusterRedis) masterNodes() []*Redis {
+    r.mutex.RLock()
+    addrs := make(map[string]bool)
+    for _, addr := range r.slots {
+        if addr != "" {
+            addrs[addr] = true
+        }
+    }
+    r.mutex.RUnlock()
+    nodes := make([]*Redis, 0, len(addrs))
+    for addr := range addrs {
+        nodes = append(nodes, r.getNode(addr))
+    }
+    return nodes
+}
+
+func (r *ClusterRedis) slotAddr(slot int) string {
+    r.mutex.RLock()
+    defer r.mutex.RUnlock()
+    if slot < 0 {
+        for _, addr := range r.slots {
+            if addr != "" {
+                return addr
+            }
+        }
+        if len(r.seeds) > 0 {
+            return r.seeds[0]
+        }
+        return ""
+    }
+    return r.slots[slot]
+}
+
+func (r *ClusterRedis) triggerRefresh() {
+    if !atomic.CompareAndSwapInt32(&r.refreshing, 0, 1) {
+        return
+    }
+    go func() {
+        defer atomic.StoreInt32(&r.refreshing, 0)
+        err := r.refreshSlots()
+        if err != nil {
+            utils.LogError("刷新Redis集群槽位表失败: %s", err.Error())
+        }
+    }()
+}
+
+//refreshSlots 依次向已知节点和种子节点请求 CLUSTER SLOTS, 使用第一个成功的结果.
+//请求使用带超时的临时连接, 不可达的节点不会阻塞刷新, 也不会为种子节点创建连接池
+func (r *ClusterRedis) refreshSlots() error {
+    candidates := make([]string, 0)
+    r.mutex.RLock()
+    for addr := range r.nodes {
+        candidates = append(candidates, addr)
+    }
+    r.mutex.RUnlock()
+    candidates = append(candidates, r.seeds...)
+
+    var lastErr error = ErrorClusterNoNode
+    for _, addr := range candidates {
+        reply, err := r.clusterSlots(addr)
+        if err != nil {
+            lastErr = err
+            continue
+        }
+        var slots [redisSlotCount]string
+        for _, iRange := range reply {
+            rng, err := redis.Values(iRange, nil)
+            if err != nil || len(rng) < 3 {
+                continue
+            }
+            start, _ := redis.Int(rng[0], nil)
+            end, _ := redis.Int(rng[1], nil)
+            master, err := redis.Values(rng[2], nil)
+            if err != nil || len(master) < 2 {
+                continue
+            }
+            host, _ := redis.String(master[0], nil)
+            port, _ := redis.Int(master[1], nil)
+            if host == "" {
+                host = strings.Split(addr, ":")[0]
+            }
+            masterAddr := fmt.Sprintf("%s:%d", host, port)
+            for s := start; s <= end && s < redisSlotCount; s++ {
+                slots[s] = masterAddr
+            }
+        }
+        r.mutex.Lock()
+        r.slots = slots
+        stales := r.removeStaleNodes()
+        r.mutex.Unlock()
+        for addr, node := range stales {
+            node.Close()
+            utils.LogInfo("Redis集群节点 %s 已不再负责任何槽位, 关闭其连接池", addr)
+        }
+        utils.LogInfo("Redis集群槽位表已更新, 来源节点 %s", addr)
+        return nil
+    }
+    return lastErr
+}
+
+func (r *ClusterRedis) clusterSlots(addr string) ([]interface{}, error) {
+    c, err := dialRedis(addr, r.config,
+        redis.DialConnectTimeout(clusterRefreshTimeout),
+        redis.DialReadTimeout(clusterRefreshTimeout),
+        redis.DialWriteTimeout(clusterRefreshTimeout))
+    if err != nil {
+        return nil, err
+    }
+    defer c.Close()
+    return redis.Values(c.Do("CLUSTER", "SLOTS"))
+}
+
+//removeStaleNodes 从节点表中移除槽位表里已经不存在的节点并返回它们, 调用时需持有 r.mutex 写锁
+func (r *ClusterRedis) removeStaleNodes() map[string]*Redis {
+    alive := make(map[string]bool)
+    for _, addr := range r.slots {
+        alive[addr] = true
+    }
+    stales := make(map[string]*Redis)
+    for addr, node := range r.nodes {
+        if !alive[addr] {
+            stales[addr] = node
+            delete(r.nodes, addr)
+        }
+    }
+    return stales
+}
+
+func (r *ClusterRedis) setSlot(slot int, addr string) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.slots[slot] = addr
+}
+
+//parseRedirect 解析 MOVED/ASK 错误, 返回类型, 槽位和目标地址
+func parseRedirect(err error) (string, int, string) {
+    e, ok := err.(redis.Error)
+    if !ok {
+        return "", 0, ""
+    }
+    parts := strings.Fields(string(e))
+    if len(parts) != 3 || (parts[0] != "MOVED" && parts[0] != "ASK") {
+        return "", 0, ""
+    }
+    slot, err := strconv.Atoi(parts[1])
+    if err != nil || slot < 0 || slot >= redisSlotCount {
+        return "", 0, ""
+    }
+    return parts[0], slot, parts[2]
+}
+
+func (r *ClusterRedis) Do(cmd string, args ...interface{}) (interface{}, error) {
+    if redisFanOutCommands[strings.ToLower(cmd)] {
+        return doOnAllNodes(r.masterNodes(), cmd, args...)
+    }
+
+    slot, err := redisCommandSlot(cmd, args)
+    if err != nil {
+        return nil, err
+    }
+    addr := r.slotAddr(slot)
+    asking := false
+    for i := 0; i < clusterMaxRedirects; i++ {
+        if addr == "" {
+            r.triggerRefresh()
+            return nil, ErrorClusterNoNode
+        }
+        node := r.getNode(addr)
+        var ret interface{}
+        if asking {
+            ret, err = node.doAsking(cmd, args...)
+        } else {
+            ret, err = node.Do(cmd, args...)
+        }
+        if err == nil {
+            return ret, nil
+        }
+
+        kind, rslot, raddr := parseRedirect(err)
+        switch kind {
+        case "MOVED":
+            r.setSlot(rslot, raddr)
+            r.triggerRefresh()
+            addr, asking = raddr, false
+            continue
+        case "ASK":
+            addr, asking = raddr, true
+            continue
+        }
+
+        if _, ok := err.(redis.Error); ok {
+            if strings.HasPrefix(err.Error(), "TRYAGAIN") || strings.HasPrefix(err.Error(), "CLUSTERDOWN") {
+                time.Sleep(time.Millisecond * 100)
+                continue
+            }
+            return ret, err
+        }
+
+        //连接层面的错误, 节点可能已经下线, 刷新槽位表后重试
+        r.refreshSlots()
+        addr, asking = r.slotAddr(slot), false
+    }
+    return nil, err
+}
+
+//doAsking 在同一条连接上先发送 ASKING 再执行命令, 用于处理迁移中槽位的 ASK 重定向
+func (r *Redis) doAsking(cmd string, args ...interface{}) (interface{}, error) {
+    encoded, err := r.encodeArgs(cmd, args)
+    if err != nil {
+        return nil, err
+    }
+    c := r.getPool().Get()
+    defer c.Close()
+
+    err = c.Send("ASKING")
+    if err != nil {
+        return nil, err
+    }
+    ret, err := c.Do(cmd, encoded...)
+    return r.decodeReply(cmd, ret), err
+}
+
+func (r *ClusterRedis) OpenConn(key uint64, owner string) bool {
+    r.open(key, owner)
+    return true
+}
+
+func (r *ClusterRedis) CloseConn(key uint64) {
+    r.close(key, r.allNodes())
+}
+
+func (r *ClusterRedis) CloseOwnerConns(owner string) {
+    r.closeOwner(owner, r.allNodes())
+}
+
+//管道命令不跟随重定向, MOVED/ASK 会原样返回给客户端, 但会触发槽位表刷新
+func (r *ClusterRedis) Send(key uint64, owner string, cmd string, args ...interface{}) error {
+    slot, err := redisCommandSlot(cmd, args)
+    if err != nil {
+        return err
+    }
+    addr := r.slotAddr(slot)
+    if addr == "" {
+        r.triggerRefresh()
+        return ErrorClusterNoNode
+    }
+    return r.send(r.getNode(addr), key, owner, cmd, args)
+}
+
+func (r *ClusterRedis) Flush(key uint64, owner string) error {
+    return r.flush(key, owner)
+}
+
+func (r *ClusterRedis) Receive(key uint64, owner string) (interface{}, error) {
+    addr := r.slotAddr(-1)
+    if addr == "" {
+        return nil, ErrorClusterNoNode
+    }
+    ret, err := r.receive(key, owner, r.getNode(addr))
+    if kind, _, _ := parseRedirect(err); kind != "" {
+        r.triggerRefresh()
+    }
+    return ret, err
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+    "errors"
+    "testing"
+
+    "github.com/garyburd/redigo/redis"
+)
+
+func TestParseRedirect(t *testing.T) {
+    cases := []struct {
+        err  error
+        kind string
+        slot int
+        addr string
+    }{
+        {redis.Error("MOVED 3999 127.0.0.1:6381"), "MOVED", 3999, "127.0.0.1:6381"},
+        {redis.Error("ASK 0 10.0.0.2:7000"), "ASK", 0, "10.0.0.2:7000"},
+        {redis.Error("MOVED 16383 node:6379"), "MOVED", 16383, "node:6379"},
+        //超出槽位范围或格式不对的重定向不被识别
+        {redis.Error("MOVED 16384 127.0.0.1:6381"), "", 0, ""},
+        {redis.Error("MOVED -1 127.0.0.1:6381"), "", 0, ""},
+        {redis.Error("MOVED abc 127.0.0.1:6381"), "", 0, ""},
+        {redis.Error("MOVED 3999"), "", 0, ""},
+        {redis.Error("ERR unknown command"), "", 0, ""},
+        {redis.Error("CLUSTERDOWN The cluster is down"), "", 0, ""},
+        //只有Redis返回的错误才可能是重定向
+        {errors.New("MOVED 3999 127.0.0.1:6381"), "", 0, ""},
+        {nil, "", 0, ""},
+    }
+    for _, c := range cases {
+        kind, slot, addr := parseRedirect(c.err)
+        if kind != c.kind || slot != c.slot || addr != c.addr {
+            t.Errorf("parseRedirect(%v) = %q, %d, %q, want %q, %d, %q", c.err, kind, slot, addr, c.kind, c.slot, c.addr)
+        }
+    }
+}
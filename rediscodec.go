@@ -0,0 +1,147 @@
+package main
+
+import (
+    "reflect"
+    "strings"
+
+    "github.com/packing/clove/errors"
+)
+
+var ErrorCodecMapMember = errors.Errorf("a map can not be used as a set member when the value codec is enabled")
+
+//编码后的值以标记字节开头, 只有带标记的值才会被解码, 其他客户端写入的数据原样返回
+const (
+    redisCodecString = 0x00
+    redisCodecIMv2   = 0x01
+)
+
+type redisValueArgs struct {
+    from int
+    step int
+    to   int
+}
+
+//各命令中属于"值"的参数位置: 从 from 开始每隔 step 个, to 为0时直到末尾, 否则不超过 to.
+//key 与 hash 的 field 始终保持原样, 以便其他工具仍能直接查看
+var redisValueArgPositions = map[string]redisValueArgs{
+    REDIS_COMMAND_SET:       {from: 1, step: 1, to: 1},
+    REDIS_COMMAND_GETSET:    {from: 1, step: 1, to: 1},
+    REDIS_COMMAND_SETNX:     {from: 1, step: 1, to: 1},
+    REDIS_COMMAND_SETEX:     {from: 2, step: 1, to: 2},
+    REDIS_COMMAND_MSET:      {from: 1, step: 2},
+    REDIS_COMMAND_HSET:      {from: 2, step: 2},
+    REDIS_COMMAND_HSETNX:    {from: 2, step: 1, to: 2},
+    REDIS_COMMAND_HMSET:     {from: 2, step: 2},
+    REDIS_COMMAND_LPUSH:     {from: 1, step: 1},
+    REDIS_COMMAND_RPUSH:     {from: 1, step: 1},
+    REDIS_COMMAND_LSET:      {from: 2, step: 1, to: 2},
+    REDIS_COMMAND_LINSERT:   {from: 2, step: 1, to: 3},
+    REDIS_COMMAND_LREM:      {from: 2, step: 1, to: 2},
+    REDIS_COMMAND_SADD:      {from: 1, step: 1},
+    REDIS_COMMAND_SREM:      {from: 1, step: 1},
+    REDIS_COMMAND_SISMEMBER: {from: 1, step: 1, to: 1},
+}
+
+//集合与有序集合的成员位置. map 编码后的字节顺序不固定, 同一个 map 会成为不同的成员, 因此拒绝
+var redisMemberArgPositions = map[string]redisValueArgs{
+    REDIS_COMMAND_SADD:      {from: 1, step: 1},
+    REDIS_COMMAND_SREM:      {from: 1, step: 1},
+    REDIS_COMMAND_SISMEMBER: {from: 1, step: 1, to: 1},
+    REDIS_COMMAND_ZADD:      {from: 2, step: 2},
+    REDIS_COMMAND_ZREM:      {from: 1, step: 1},
+    REDIS_COMMAND_ZSCORE:    {from: 1, step: 1, to: 1},
+    REDIS_COMMAND_ZRANK:     {from: 1, step: 1, to: 1},
+    REDIS_COMMAND_ZREVRANK:  {from: 1, step: 1, to: 1},
+    REDIS_COMMAND_ZINCRBY:   {from: 2, step: 1, to: 2},
+}
+
+const (
+    redisReplyValue = iota + 1
+    redisReplyValues
+    redisReplyPairs
+)
+
+//返回值中需要解码的命令. redisReplyValue 单个值, redisReplyValues 数组中的每个值, redisReplyPairs 数组中的奇数位
+var redisValueReplies = map[string]int{
+    REDIS_COMMAND_GET:         redisReplyValue,
+    REDIS_COMMAND_GETSET:      redisReplyValue,
+    REDIS_COMMAND_HGET:        redisReplyValue,
+    REDIS_COMMAND_LINDEX:      redisReplyValue,
+    REDIS_COMMAND_LPOP:        redisReplyValue,
+    REDIS_COMMAND_RPOP:        redisReplyValue,
+    REDIS_COMMAND_SPOP:        redisReplyValues,
+    REDIS_COMMAND_SRANDMEMBER: redisReplyValues,
+    REDIS_COMMAND_MGET:        redisReplyValues,
+    REDIS_COMMAND_HMGET:       redisReplyValues,
+    REDIS_COMMAND_HVALS:       redisReplyValues,
+    REDIS_COMMAND_LRANGE:      redisReplyValues,
+    REDIS_COMMAND_SMEMBERS:    redisReplyValues,
+    REDIS_COMMAND_SDIFF:       redisReplyValues,
+    REDIS_COMMAND_SINTER:      redisReplyValues,
+    REDIS_COMMAND_SUNION:      redisReplyValues,
+    REDIS_COMMAND_HGETALL:     redisReplyPairs,
+}
+
+func (r *Redis) encodeArgs(cmd string, args []interface{}) ([]interface{}, error) {
+    if !r.valueCodec {
+        return args, nil
+    }
+    lcmd := strings.ToLower(cmd)
+    pos, ok := redisMemberArgPositions[lcmd]
+    if ok {
+        for i := pos.from; i < len(args); i += pos.step {
+            if pos.to > 0 && i > pos.to {
+                break
+            }
+            if args[i] != nil && reflect.TypeOf(args[i]).Kind() == reflect.Map {
+                return nil, ErrorCodecMapMember
+            }
+        }
+    }
+    pos, ok = redisValueArgPositions[lcmd]
+    if !ok {
+        return args, nil
+    }
+    encoded := make([]interface{}, len(args))
+    copy(encoded, args)
+    for i := pos.from; i < len(encoded); i += pos.step {
+        if pos.to > 0 && i > pos.to {
+            break
+        }
+        encoded[i] = r.packData(encoded[i])
+    }
+    return encoded, nil
+}
+
+func (r *Redis) decodeReply(cmd string, reply interface{}) interface{} {
+    if !r.valueCodec || reply == nil {
+        return reply
+    }
+    switch redisValueReplies[strings.ToLower(cmd)] {
+    case redisReplyValue:
+        return r.unPackData(reply)
+    case redisReplyValues:
+        vs, ok := reply.([]interface{})
+        if !ok {
+            return r.unPackData(reply)
+        }
+        for i, v := range vs {
+            vs[i] = r.unPackData(v)
+        }
+        return vs
+    case redisReplyPairs:
+        vs, ok := reply.([]interface{})
+        if !ok {
+            return reply
+        }
+        for i := 0; i+1 < len(vs); i += 2 {
+            b, ok := vs[i].([]byte)
+            if ok {
+                vs[i] = string(b)
+            }
+            vs[i+1] = r.unPackData(vs[i+1])
+        }
+        return vs
+    }
+    return reply
+}
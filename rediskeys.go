@@ -0,0 +1,193 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+)
+
+//redisKeySpec 描述命令参数中key的位置, 与Redis COMMAND返回的 first/last/step 含义一致(下标从0开始, 不含命令名).
+//last 为负数时从末尾倒数, -1 表示最后一个参数
+type redisKeySpec struct {
+    first int
+    last  int
+    step  int
+}
+
+var redisKeySpecs = map[string]redisKeySpec{
+    "del":              {0, -1, 1},
+    "unlink":           {0, -1, 1},
+    "exists":           {0, -1, 1},
+    "touch":            {0, -1, 1},
+    "watch":            {0, -1, 1},
+    "mget":             {0, -1, 1},
+    "mset":             {0, -1, 2},
+    "msetnx":           {0, -1, 2},
+    "sdiff":            {0, -1, 1},
+    "sdiffstore":       {0, -1, 1},
+    "sinter":           {0, -1, 1},
+    "sinterstore":      {0, -1, 1},
+    "sunion":           {0, -1, 1},
+    "sunionstore":      {0, -1, 1},
+    "pfcount":          {0, -1, 1},
+    "pfmerge":          {0, -1, 1},
+    "rename":           {0, 1, 1},
+    "renamenx":         {0, 1, 1},
+    "smove":            {0, 1, 1},
+    "rpoplpush":        {0, 1, 1},
+    "lmove":            {0, 1, 1},
+    "brpoplpush":       {0, 1, 1},
+    "blpop":            {0, -2, 1},
+    "brpop":            {0, -2, 1},
+    "bzpopmin":         {0, -2, 1},
+    "bzpopmax":         {0, -2, 1},
+    "bitop":            {1, -1, 1},
+    "ping":             {-1, -1, 0},
+    "echo":             {-1, -1, 0},
+    "info":             {-1, -1, 0},
+    "time":             {-1, -1, 0},
+    "keys":             {-1, -1, 0},
+    "scan":             {-1, -1, 0},
+    "dbsize":           {-1, -1, 0},
+    "flushall":         {-1, -1, 0},
+    "flushdb":          {-1, -1, 0},
+    "randomkey":        {-1, -1, 0},
+    "multi":            {-1, -1, 0},
+    "exec":             {-1, -1, 0},
+    "discard":          {-1, -1, 0},
+    "unwatch":          {-1, -1, 0},
+    "publish":          {-1, -1, 0},
+    "subscribe":        {-1, -1, 0},
+    "unsubscribe":      {-1, -1, 0},
+    "psubscribe":       {-1, -1, 0},
+    "punsubscribe":     {-1, -1, 0},
+    "script":           {-1, -1, 0},
+    "select":           {-1, -1, 0},
+    "auth":             {-1, -1, 0},
+    "client":           {-1, -1, 0},
+    "config":           {-1, -1, 0},
+    "cluster":          {-1, -1, 0},
+    "command":          {-1, -1, 0},
+    "debug":            {-1, -1, 0},
+    "memory":           {1, 1, 1},
+    "object":           {1, 1, 1},
+    "xinfo":            {1, 1, 1},
+    "xgroup":           {1, 1, 1},
+}
+
+//numkeys 之后紧跟 key 的命令, 值为 numkeys 参数的下标; store 表示第一个参数是目标key
+var redisNumKeysCommands = map[string]struct {
+    numkeys int
+    store   bool
+}{
+    "eval":        {1, false},
+    "evalsha":     {1, false},
+    "zunionstore": {1, true},
+    "zinterstore": {1, true},
+    "zdiffstore":  {1, true},
+    "zunion":      {0, false},
+    "zinter":      {0, false},
+    "zdiff":       {0, false},
+    "sintercard":  {0, false},
+    "lmpop":       {0, false},
+    "zmpop":       {0, false},
+}
+
+//redisKeysUnknown 判断命令是否会访问无法从参数位置确定的key, 例如 SORT 的 BY/GET 模式和 GEORADIUS 的 STORE 选项
+func redisKeysUnknown(cmd string, args []interface{}) bool {
+    switch strings.ToLower(cmd) {
+    case "sort", "sort_ro":
+        for i := 1; i < len(args); i++ {
+            opt := strings.ToLower(redisArgString(args[i]))
+            if opt == "by" || opt == "get" {
+                return true
+            }
+        }
+    case "georadius", "georadiusbymember":
+        for _, arg := range args {
+            opt := strings.ToLower(redisArgString(arg))
+            if opt == "store" || opt == "storedist" {
+                return true
+            }
+        }
+    case "migrate":
+        return true
+    }
+    return false
+}
+
+//其余命令默认第一个参数为key
+var redisDefaultKeySpec = redisKeySpec{0, 0, 1}
+
+func redisArgString(v interface{}) string {
+    switch s := v.(type) {
+    case string:
+        return s
+    case []byte:
+        return string(s)
+    }
+    return fmt.Sprint(v)
+}
+
+//redisKeyIndexes 返回命令参数中属于key的下标
+func redisKeyIndexes(cmd string, args []interface{}) []int {
+    cmd = strings.ToLower(cmd)
+    nk, ok := redisNumKeysCommands[cmd]
+    if ok {
+        if len(args) <= nk.numkeys {
+            return nil
+        }
+        indexes := make([]int, 0)
+        if nk.store {
+            indexes = append(indexes, 0)
+        }
+        n := tryParseInt(args[nk.numkeys])
+        for i := nk.numkeys + 1; i <= nk.numkeys+n && i < len(args); i++ {
+            indexes = append(indexes, i)
+        }
+        return indexes
+    }
+    if cmd == "xread" || cmd == "xreadgroup" {
+        //STREAMS 之后前一半是key, 后一半是对应的ID
+        for i, arg := range args {
+            if strings.ToLower(redisArgString(arg)) != "streams" {
+                continue
+            }
+            n := (len(args) - i - 1) / 2
+            indexes := make([]int, 0, n)
+            for j := i + 1; j <= i+n; j++ {
+                indexes = append(indexes, j)
+            }
+            return indexes
+        }
+        return nil
+    }
+
+    spec, ok := redisKeySpecs[cmd]
+    if !ok {
+        spec = redisDefaultKeySpec
+    }
+    if spec.first < 0 || spec.step <= 0 || spec.first >= len(args) {
+        return nil
+    }
+    last := spec.last
+    if last < 0 {
+        last = len(args) + last
+    }
+    if last >= len(args) {
+        last = len(args) - 1
+    }
+    indexes := make([]int, 0)
+    for i := spec.first; i <= last; i += spec.step {
+        indexes = append(indexes, i)
+    }
+    return indexes
+}
+
+func redisCommandKeys(cmd string, args []interface{}) []string {
+    indexes := redisKeyIndexes(cmd, args)
+    keys := make([]string, len(indexes))
+    for i, idx := range indexes {
+        keys[i] = redisArgString(args[idx])
+    }
+    return keys
+}
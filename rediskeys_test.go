@@ -0,0 +1,90 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestRedisKeyIndexes(t *testing.T) {
+    cases := []struct {
+        cmd     string
+        args    []interface{}
+        indexes []int
+    }{
+        //默认第一个参数为key, 其余为值
+        {"get", []interface{}{"a"}, []int{0}},
+        {"SET", []interface{}{"a", "v", "EX", 10}, []int{0}},
+        {"hset", []interface{}{"h", "f1", "v1", "f2", "v2"}, []int{0}},
+        //全部参数都是key
+        {"del", []interface{}{"a", "b", "c"}, []int{0, 1, 2}},
+        {"mget", []interface{}{"a", "b"}, []int{0, 1}},
+        //key与值交替
+        {"mset", []interface{}{"a", "1", "b", "2"}, []int{0, 2}},
+        //固定的前两个参数
+        {"rename", []interface{}{"a", "b"}, []int{0, 1}},
+        {"lmove", []interface{}{"a", "b", "LEFT", "RIGHT"}, []int{0, 1}},
+        //最后一个参数是超时
+        {"blpop", []interface{}{"a", "b", 5}, []int{0, 1}},
+        //第一个参数是操作名
+        {"bitop", []interface{}{"AND", "dest", "a", "b"}, []int{1, 2, 3}},
+        {"object", []interface{}{"ENCODING", "a"}, []int{1}},
+        {"xinfo", []interface{}{"STREAM", "s"}, []int{1}},
+        //numkeys 之后的key
+        {"eval", []interface{}{"return 1", 2, "a", "b", "arg"}, []int{2, 3}},
+        {"evalsha", []interface{}{"sha", "0", "arg"}, []int{}},
+        {"zunionstore", []interface{}{"dest", 2, "a", "b", "WEIGHTS", 1, 2}, []int{0, 2, 3}},
+        {"zunion", []interface{}{2, "a", "b"}, []int{1, 2}},
+        {"lmpop", []interface{}{2, "a", "b", "LEFT"}, []int{1, 2}},
+        //numkeys 超出实际参数时只取存在的参数
+        {"eval", []interface{}{"return 1", 3, "a"}, []int{2}},
+        {"eval", []interface{}{"return 1"}, nil},
+        //STREAMS 之后前一半是key
+        {"xread", []interface{}{"COUNT", 2, "STREAMS", "s1", "s2", "0", "0"}, []int{3, 4}},
+        {"xreadgroup", []interface{}{"GROUP", "g", "c", "streams", "s1", ">"}, []int{4}},
+        {"xread", []interface{}{"COUNT", 2}, nil},
+        //没有key的命令
+        {"ping", []interface{}{}, nil},
+        {"publish", []interface{}{"ch", "msg"}, nil},
+        {"keys", []interface{}{"*"}, nil},
+        {"get", []interface{}{}, nil},
+    }
+    for _, c := range cases {
+        indexes := redisKeyIndexes(c.cmd, c.args)
+        if len(indexes) == 0 && len(c.indexes) == 0 {
+            continue
+        }
+        if !reflect.DeepEqual(indexes, c.indexes) {
+            t.Errorf("redisKeyIndexes(%s %v) = %v, want %v", c.cmd, c.args, indexes, c.indexes)
+        }
+    }
+}
+
+func TestRedisCommandKeys(t *testing.T) {
+    keys := redisCommandKeys("mset", []interface{}{[]byte("a"), 1, "b", 2})
+    if !reflect.DeepEqual(keys, []string{"a", "b"}) {
+        t.Errorf("redisCommandKeys(mset) = %v", keys)
+    }
+}
+
+func TestRedisKeysUnknown(t *testing.T) {
+    cases := []struct {
+        cmd     string
+        args    []interface{}
+        unknown bool
+    }{
+        {"sort", []interface{}{"a"}, false},
+        {"sort", []interface{}{"a", "LIMIT", 0, 10}, false},
+        {"sort", []interface{}{"a", "BY", "w_*"}, true},
+        {"SORT_RO", []interface{}{"a", "get", "o_*"}, true},
+        {"georadius", []interface{}{"g", 1, 2, 3, "km"}, false},
+        {"georadius", []interface{}{"g", 1, 2, 3, "km", "STORE", "dest"}, true},
+        {"georadiusbymember", []interface{}{"g", "m", 3, "km", "storedist", "dest"}, true},
+        {"migrate", []interface{}{"host", 6379, "a", 0, 1000}, true},
+        {"get", []interface{}{"by"}, false},
+    }
+    for _, c := range cases {
+        if unknown := redisKeysUnknown(c.cmd, c.args); unknown != c.unknown {
+            t.Errorf("redisKeysUnknown(%s %v) = %v, want %v", c.cmd, c.args, unknown, c.unknown)
+        }
+    }
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+    "strings"
+    "sync/atomic"
+
+    "github.com/garyburd/redigo/redis"
+    "github.com/packing/clove/utils"
+)
+
+//IReplicaRedis 由支持只读副本的实现提供, OnRedisDo 中的只读命令优先通过 DoReplica 执行
+type IReplicaRedis interface {
+    DoReplica(string, ...interface{}) (interface{}, error)
+}
+
+//withoutReplicas 只有单节点(含Sentinel)模式支持副本读, 其他模式下忽略 replicas 配置并给出警告
+func withoutReplicas(config RedisConfig, mode string) RedisConfig {
+    if len(config.Replicas) > 0 {
+        utils.LogWarn("redis配置节中的只读副本replicas在%s模式下不受支持, 已忽略", mode)
+        config.Replicas = nil
+    }
+    return config
+}
+
+//redisReadCommands 可以在副本上执行的只读命令
+var redisReadCommands = map[string]bool{
+    "get":              true,
+    "mget":             true,
+    "strlen":           true,
+    "getrange":         true,
+    "exists":           true,
+    "type":             true,
+    "ttl":              true,
+    "pttl":             true,
+    "keys":             true,
+    "scan":             true,
+    "dbsize":           true,
+    "hget":             true,
+    "hmget":            true,
+    "hgetall":          true,
+    "hexists":          true,
+    "hkeys":            true,
+    "hvals":            true,
+    "hlen":             true,
+    "hstrlen":          true,
+    "hscan":            true,
+    "llen":             true,
+    "lindex":           true,
+    "lrange":           true,
+    "scard":            true,
+    "sismember":        true,
+    "smembers":         true,
+    "srandmember":      true,
+    "sdiff":            true,
+    "sinter":           true,
+    "sunion":           true,
+    "sscan":            true,
+    "zcard":            true,
+    "zcount":           true,
+    "zrange":           true,
+    "zrangebyscore":    true,
+    "zrevrange":        true,
+    "zrevrangebyscore": true,
+    "zrank":            true,
+    "zrevrank":         true,
+    "zscore":           true,
+    "zscan":            true,
+}
+
+func isRedisReadCommand(cmd string) bool {
+    return redisReadCommands[strings.ToLower(cmd)]
+}
+
+//replicaPool 轮询选择一个副本连接池, 没有副本时返回nil
+func (r *Redis) replicaPool() *redis.Pool {
+    r.poolMutex.RLock()
+    defer r.poolMutex.RUnlock()
+    if len(r.replicas) == 0 {
+        return nil
+    }
+    n := atomic.AddUint64(&r.replicaNext, 1)
+    return r.replicas[n%uint64(len(r.replicas))]
+}
+
+//DoReplica 在副本上执行只读命令, 没有可用副本或副本连接失败时回退到主节点
+func (r *Redis) DoReplica(cmd string, args ...interface{}) (interface{}, error) {
+    pool := r.replicaPool()
+    if pool == nil || !isRedisReadCommand(cmd) {
+        return r.Do(cmd, args...)
+    }
+
+    encoded, err := r.encodeArgs(cmd, args)
+    if err != nil {
+        return nil, err
+    }
+    c := pool.Get()
+    defer c.Close()
+
+    ret, err := c.Do(cmd, encoded...)
+    if err != nil {
+        if _, ok := err.(redis.Error); !ok {
+            return r.Do(cmd, args...)
+        }
+    }
+    return r.decodeReply(cmd, ret), err
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/garyburd/redigo/redis"
+    "github.com/packing/clove/errors"
+    "github.com/packing/clove/utils"
+)
+
+const sentinelReplicaRefreshInterval = time.Second * 30
+
+var ErrorNoSentinel = errors.Errorf("no sentinel can resolve the master address")
+
+//SentinelRedis 通过 Sentinel 获取主节点地址. 连接池在每次新建连接时解析主节点,
+//收到 +switch-master 后立即重建连接池, 并可选地维护一组只读副本的连接池
+//与 Sentinel 之间的连接使用 sentinel.tls 配置, 与数据节点的 tls 配置相互独立
+type SentinelRedis struct {
+    Redis
+    config     RedisConfig
+    masterAddr string
+    addrMutex  sync.Mutex
+}
+
+func (r *SentinelRedis) InitPool(config RedisConfig) {
+    r.config = config
+    _, err := r.resolveMaster()
+    if err != nil {
+        utils.LogError("通过Sentinel解析Redis主节点失败: %s", err.Error())
+    }
+    r.Redis.initPool(config, r.createMasterPool())
+    if config.Sentinel.ReadReplicas {
+        r.refreshReplicas()
+        go func() {
+            for range time.Tick(sentinelReplicaRefreshInterval) {
+                r.refreshReplicas()
+            }
+        }()
+    }
+    go r.watchSwitchMaster()
+    utils.LogInfo("初始化Redis Sentinel成功. master: %s, sentinels: %s", config.Sentinel.MasterName, strings.Join(config.Sentinel.Addrs, ","))
+}
+
+func (r *SentinelRedis) createMasterPool() *redis.Pool {
+    pool := createRedisPool("", r.config, nil)
+    pool.Dial = func() (redis.Conn, error) {
+        addr, err := r.resolveMaster()
+        if err != nil {
+            return nil, err
+        }
+        utils.LogInfo("Redis 连接至主节点 %s", addr)
+        return dialRedis(addr, r.config)
+    }
+    return pool
+}
+
+func (r *SentinelRedis) dialSentinel(addr string) (redis.Conn, error) {
+    ops := []redis.DialOption{redis.DialConnectTimeout(time.Second * 2), redis.DialReadTimeout(time.Second * 2)}
+    if r.config.Sentinel.Pwd != "" {
+        ops = append(ops, redis.DialPassword(r.config.Sentinel.Pwd))
+    }
+    tlsOps, err := redisTLSOptions(r.config.Sentinel.TLS)
+    if err != nil {
+        return nil, err
+    }
+    return redis.Dial("tcp", addr, append(ops, tlsOps...)...)
+}
+
+//sentinelDo 依次尝试各个 Sentinel, 返回第一个成功的应答
+func (r *SentinelRedis) sentinelDo(cmd string, args ...interface{}) (interface{}, error) {
+    var lastErr error = ErrorNoSentinel
+    for _, addr := range r.config.Sentinel.Addrs {
+        c, err := r.dialSentinel(addr)
+        if err != nil {
+            lastErr = err
+            continue
+        }
+        ret, err := c.Do(cmd, args...)
+        c.Close()
+        if err == nil && ret != nil {
+            return ret, nil
+        }
+        if err != nil {
+            lastErr = err
+        }
+    }
+    return nil, lastErr
+}
+
+func (r *SentinelRedis) resolveMaster() (string, error) {
+    reply, err := redis.Strings(r.sentinelDo("SENTINEL", "get-master-addr-by-name", r.config.Sentinel.MasterName))
+    if err != nil {
+        return "", err
+    }
+    if len(reply) != 2 {
+        return "", ErrorNoSentinel
+    }
+    addr := fmt.Sprintf("%s:%s", reply[0], reply[1])
+    r.addrMutex.Lock()
+    if r.masterAddr != addr {
+        utils.LogInfo("Redis主节点 %s 解析为 %s", r.config.Sentinel.MasterName, addr)
+        r.masterAddr = addr
+    }
+    r.addrMutex.Unlock()
+    return addr, nil
+}
+
+func (r *SentinelRedis) refreshReplicas() {
+    reply, err := redis.Values(r.sentinelDo("SENTINEL", "replicas", r.config.Sentinel.MasterName))
+    if err != nil {
+        utils.LogError("通过Sentinel获取Redis副本列表失败: %s", err.Error())
+        return
+    }
+    addrs := make([]string, 0)
+    for _, item := range reply {
+        m, err := redis.StringMap(item, nil)
+        if err != nil {
+            continue
+        }
+        flags := m["flags"]
+        if strings.Contains(flags, "s_down") || strings.Contains(flags, "o_down") || strings.Contains(flags, "disconnected") {
+            continue
+        }
+        addrs = append(addrs, fmt.Sprintf("%s:%s", m["ip"], m["port"]))
+    }
+    r.setReplicas(addrs, r.config)
+}
+
+//watchSwitchMaster 订阅 Sentinel 的 +switch-master 事件, 主从切换后重建连接池
+func (r *SentinelRedis) watchSwitchMaster() {
+    for {
+        for _, addr := range r.config.Sentinel.Addrs {
+            err := r.receiveSwitchMaster(addr)
+            if err != nil {
+                utils.LogError("Sentinel %s 订阅中断: %s", addr, err.Error())
+            }
+            time.Sleep(time.Second)
+        }
+    }
+}
+
+func (r *SentinelRedis) receiveSwitchMaster(addr string) error {
+    c, err := r.dialSentinel(addr)
+    if err != nil {
+        return err
+    }
+    defer c.Close()
+
+    psc := redis.PubSubConn{Conn: c}
+    err = psc.Subscribe("+switch-master")
+    if err != nil {
+        return err
+    }
+    for {
+        switch v := psc.ReceiveWithTimeout(0).(type) {
+        case redis.Message:
+            //<master name> <old ip> <old port> <new ip> <new port>
+            parts := strings.Fields(string(v.Data))
+            if len(parts) != 5 || parts[0] != r.config.Sentinel.MasterName {
+                continue
+            }
+            newAddr := fmt.Sprintf("%s:%s", parts[3], parts[4])
+            utils.LogWarn("Redis主节点 %s 已切换: %s:%s => %s", parts[0], parts[1], parts[2], newAddr)
+            r.addrMutex.Lock()
+            r.masterAddr = newAddr
+            r.addrMutex.Unlock()
+            r.resetPool(r.createMasterPool())
+            if r.config.Sentinel.ReadReplicas {
+                r.refreshReplicas()
+            }
+        case error:
+            return v
+        }
+    }
+}
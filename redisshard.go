@@ -0,0 +1,300 @@
+package main
+
+import (
+    "math/rand"
+    "strings"
+    "sync"
+
+    "github.com/packing/clove/errors"
+    "github.com/packing/clove/utils"
+)
+
+const redisSlotCount = 16384
+
+var ErrorCrossSlot = errors.Errorf("CROSSSLOT Keys in request don't hash to the same slot")
+var ErrorShardKeyless = errors.Errorf("the command has no key and can not be routed to a single node")
+var ErrorShardUnknownKeys = errors.Errorf("the keys of the command can not be determined for routing")
+
+//需要在每个节点上执行并合并结果的全局命令
+var redisFanOutCommands = map[string]bool{
+    "keys":      true,
+    "dbsize":    true,
+    "flushall":  true,
+    "flushdb":   true,
+    "randomkey": true,
+    "script":    true,
+}
+
+//结果与数据无关, 可以发往任意一个节点的无key命令
+var redisAnyNodeCommands = map[string]bool{
+    "ping":    true,
+    "echo":    true,
+    "time":    true,
+    "info":    true,
+    "command": true,
+}
+
+var crc16Table [256]uint16
+
+func init() {
+    for i := 0; i < 256; i++ {
+        crc := uint16(i) << 8
+        for j := 0; j < 8; j++ {
+            if crc&0x8000 != 0 {
+                crc = crc<<1 ^ 0x1021
+            } else {
+                crc <<= 1
+            }
+        }
+        crc16Table[i] = crc
+    }
+}
+
+//crc16 CRC16-CCITT(XMODEM), 与 Redis Cluster 的实现一致
+func crc16(s string) uint16 {
+    var crc uint16
+    for i := 0; i < len(s); i++ {
+        crc = crc<<8 ^ crc16Table[byte(crc>>8)^s[i]]
+    }
+    return crc
+}
+
+//redisKeySlot 计算key所属的槽位, key中出现非空的 {hash tag} 时只对tag部分计算
+func redisKeySlot(key string) int {
+    s := strings.IndexByte(key, '{')
+    if s >= 0 {
+        e := strings.IndexByte(key[s+1:], '}')
+        if e > 0 {
+            key = key[s+1 : s+1+e]
+        }
+    }
+    return int(crc16(key)) % redisSlotCount
+}
+
+//redisCommandSlot 返回命令所属的槽位, 可以发往任意节点的无key命令返回-1, 多个key不在同一槽位时返回 ErrorCrossSlot.
+//其余无key命令(SCAN, PUBLISH, MULTI 等)以及无法确定key的命令(带 BY/GET 的 SORT 等)被拒绝
+func redisCommandSlot(cmd string, args []interface{}) (int, error) {
+    if redisKeysUnknown(cmd, args) {
+        return -1, ErrorShardUnknownKeys
+    }
+    keys := redisCommandKeys(cmd, args)
+    if len(keys) == 0 {
+        if redisAnyNodeCommands[strings.ToLower(cmd)] {
+            return -1, nil
+        }
+        return -1, ErrorShardKeyless
+    }
+    slot := -1
+    for _, key := range keys {
+        ks := redisKeySlot(key)
+        if slot >= 0 && ks != slot {
+            return -1, ErrorCrossSlot
+        }
+        slot = ks
+    }
+    return slot, nil
+}
+
+//redisPipelines 记录管道命令被发往了哪个节点, Receive 时按发送顺序从对应节点读取应答
+type redisPipelines struct {
+    owners map[uint64]string
+    routes map[uint64][]*Redis
+    mutex  sync.Mutex
+}
+
+func (p *redisPipelines) init() {
+    p.owners = make(map[uint64]string)
+    p.routes = make(map[uint64][]*Redis)
+}
+
+func (p *redisPipelines) open(key uint64, owner string) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    p.owners[key] = owner
+}
+
+func (p *redisPipelines) close(key uint64, nodes []*Redis) {
+    p.mutex.Lock()
+    delete(p.owners, key)
+    delete(p.routes, key)
+    p.mutex.Unlock()
+    for _, node := range nodes {
+        node.CloseConn(key)
+    }
+}
+
+func (p *redisPipelines) closeOwner(owner string, nodes []*Redis) {
+    p.mutex.Lock()
+    for key, o := range p.owners {
+        if o == owner {
+            delete(p.owners, key)
+            delete(p.routes, key)
+        }
+    }
+    p.mutex.Unlock()
+    for _, node := range nodes {
+        node.CloseOwnerConns(owner)
+    }
+}
+
+func (p *redisPipelines) send(node *Redis, key uint64, owner string, cmd string, args []interface{}) error {
+    err := node.Send(key, owner, cmd, args...)
+    if err == nil {
+        p.mutex.Lock()
+        if owner != "" {
+            p.owners[key] = owner
+        }
+        p.routes[key] = append(p.routes[key], node)
+        p.mutex.Unlock()
+    }
+    return err
+}
+
+func (p *redisPipelines) flush(key uint64, owner string) error {
+    p.mutex.Lock()
+    flushed := make(map[*Redis]bool)
+    for _, node := range p.routes[key] {
+        flushed[node] = true
+    }
+    p.mutex.Unlock()
+    for node := range flushed {
+        err := node.Flush(key, owner)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (p *redisPipelines) receive(key uint64, owner string, fallback *Redis) (interface{}, error) {
+    p.mutex.Lock()
+    routes := p.routes[key]
+    if len(routes) == 0 {
+        p.mutex.Unlock()
+        return fallback.Receive(key, owner)
+    }
+    node := routes[0]
+    p.routes[key] = routes[1:]
+    p.mutex.Unlock()
+    return node.Receive(key, owner)
+}
+
+//ShardedRedis 按槽位把命令静态地分派到多个互相独立的Redis节点, 槽位平均分配给配置中的各个节点
+type ShardedRedis struct {
+    redisPipelines
+    nodes []*Redis
+}
+
+func (r *ShardedRedis) InitPool(config RedisConfig) {
+    config = withoutReplicas(config, "分片")
+    r.redisPipelines.init()
+    r.nodes = make([]*Redis, len(config.Nodes))
+    for i, addr := range config.Nodes {
+        nodeConfig := config
+        nodeConfig.Addr = addr
+        nodeConfig.Replicas = nil
+        r.nodes[i] = new(Redis)
+        r.nodes[i].InitPool(nodeConfig)
+    }
+    utils.LogInfo("初始化Redis分片成功. 节点数: %d", len(r.nodes))
+}
+
+func (r *ShardedRedis) route(cmd string, args []interface{}) (*Redis, error) {
+    slot, err := redisCommandSlot(cmd, args)
+    if err != nil {
+        return nil, err
+    }
+    if slot < 0 {
+        return r.nodes[0], nil
+    }
+    return r.nodes[slot*len(r.nodes)/redisSlotCount], nil
+}
+
+func (r *ShardedRedis) OpenConn(key uint64, owner string) bool {
+    r.open(key, owner)
+    return true
+}
+
+func (r *ShardedRedis) CloseConn(key uint64) {
+    r.close(key, r.nodes)
+}
+
+func (r *ShardedRedis) CloseOwnerConns(owner string) {
+    r.closeOwner(owner, r.nodes)
+}
+
+func (r *ShardedRedis) Do(cmd string, args ...interface{}) (interface{}, error) {
+    if redisFanOutCommands[strings.ToLower(cmd)] {
+        return doOnAllNodes(r.nodes, cmd, args...)
+    }
+
+    node, err := r.route(cmd, args)
+    if err != nil {
+        return nil, err
+    }
+    return node.Do(cmd, args...)
+}
+
+//doOnAllNodes 在每个节点上执行不含key的全局命令并合并结果
+func doOnAllNodes(nodes []*Redis, cmd string, args ...interface{}) (interface{}, error) {
+    switch strings.ToLower(cmd) {
+    case "keys":
+        ret := make([]interface{}, 0)
+        for _, node := range nodes {
+            keys, err := node.Do(cmd, args...)
+            if err != nil {
+                return nil, err
+            }
+            ks, _ := keys.([]interface{})
+            ret = append(ret, ks...)
+        }
+        return ret, nil
+    case "dbsize":
+        var c int64
+        for _, node := range nodes {
+            n, err := node.Do(cmd, args...)
+            if err != nil {
+                return nil, err
+            }
+            c += tryParseInt64(n)
+        }
+        return c, nil
+    case "randomkey":
+        for _, i := range rand.Perm(len(nodes)) {
+            key, err := nodes[i].Do(cmd, args...)
+            if err != nil || key != nil {
+                return key, err
+            }
+        }
+        return nil, nil
+    default:
+        //SCRIPT LOAD 在每个节点上得到相同的sha, 返回第一个节点的结果即可
+        var ret interface{}
+        for i, node := range nodes {
+            r, err := node.Do(cmd, args...)
+            if err != nil {
+                return nil, err
+            }
+            if i == 0 {
+                ret = r
+            }
+        }
+        return ret, nil
+    }
+}
+
+func (r *ShardedRedis) Send(key uint64, owner string, cmd string, args ...interface{}) error {
+    node, err := r.route(cmd, args)
+    if err != nil {
+        return err
+    }
+    return r.send(node, key, owner, cmd, args)
+}
+
+func (r *ShardedRedis) Flush(key uint64, owner string) error {
+    return r.flush(key, owner)
+}
+
+func (r *ShardedRedis) Receive(key uint64, owner string) (interface{}, error) {
+    return r.receive(key, owner, r.nodes[0])
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestCRC16(t *testing.T) {
+    //CRC16-CCITT(XMODEM) 的标准校验值
+    if v := crc16("123456789"); v != 0x31c3 {
+        t.Fatalf("crc16(123456789) = %#x, want 0x31c3", v)
+    }
+    if v := crc16(""); v != 0 {
+        t.Fatalf("crc16(\"\") = %#x, want 0", v)
+    }
+}
+
+func TestRedisKeySlot(t *testing.T) {
+    //期望值与 CLUSTER KEYSLOT 的结果一致
+    cases := []struct {
+        key  string
+        slot int
+    }{
+        {"foo", 12182},
+        {"bar", 5061},
+        {"hello", 866},
+        {"somekey", 11058},
+        {"foo{hash_tag}", 2515},
+        {"bar{hash_tag}", 2515},
+    }
+    for _, c := range cases {
+        if slot := redisKeySlot(c.key); slot != c.slot {
+            t.Errorf("redisKeySlot(%q) = %d, want %d", c.key, slot, c.slot)
+        }
+    }
+}
+
+func TestRedisKeySlotHashTag(t *testing.T) {
+    cases := []struct {
+        key    string
+        hashed string
+    }{
+        //只对第一个非空的 {} 中的内容计算
+        {"{user1000}.following", "user1000"},
+        {"{user1000}.followers", "user1000"},
+        {"foo{bar}{zap}", "bar"},
+        {"foo{{bar}}zap", "{bar"},
+        //空的 {} 或没有闭合时对整个key计算
+        {"foo{}{bar}", "foo{}{bar}"},
+        {"foo{bar", "foo{bar"},
+        {"foo}bar{", "foo}bar{"},
+    }
+    for _, c := range cases {
+        want := int(crc16(c.hashed)) % redisSlotCount
+        if slot := redisKeySlot(c.key); slot != want {
+            t.Errorf("redisKeySlot(%q) = %d, want slot of %q (%d)", c.key, slot, c.hashed, want)
+        }
+    }
+}
+
+func TestRedisCommandSlot(t *testing.T) {
+    cases := []struct {
+        cmd  string
+        args []interface{}
+        slot int
+        err  error
+    }{
+        {"get", []interface{}{"foo"}, 12182, nil},
+        {"mget", []interface{}{"{a}1", "{a}2"}, redisKeySlot("a"), nil},
+        {"mget", []interface{}{"foo", "bar"}, -1, ErrorCrossSlot},
+        {"ping", []interface{}{}, -1, nil},
+        {"multi", []interface{}{}, -1, ErrorShardKeyless},
+        {"sort", []interface{}{"foo", "BY", "w_*"}, -1, ErrorShardUnknownKeys},
+    }
+    for _, c := range cases {
+        slot, err := redisCommandSlot(c.cmd, c.args)
+        if slot != c.slot || err != c.err {
+            t.Errorf("redisCommandSlot(%s %v) = %d, %v, want %d, %v", c.cmd, c.args, slot, err, c.slot, c.err)
+        }
+    }
+}
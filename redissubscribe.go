@@ -0,0 +1,293 @@
+package main
+
+import (
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/garyburd/redigo/redis"
+    "github.com/packing/clove/codecs"
+    "github.com/packing/clove/errors"
+    "github.com/packing/clove/messages"
+    "github.com/packing/clove/utils"
+)
+
+var ErrorPubSubNotSupported = errors.Errorf("the redis backend does not support subscriptions")
+
+//IPubSubRedis 由能够提供订阅连接的实现提供, 返回的连接由调用方负责关闭
+type IPubSubRedis interface {
+    PubSubConn() (redis.Conn, error)
+}
+
+func (r *Redis) PubSubConn() (redis.Conn, error) {
+    c := r.getPool().Get()
+    err := c.Err()
+    if err != nil {
+        c.Close()
+        return nil, err
+    }
+    return c, nil
+}
+
+//集群中的发布消息会广播到所有节点, 任意节点都可以订阅
+func (r *ClusterRedis) PubSubConn() (redis.Conn, error) {
+    addr := r.slotAddr(-1)
+    if addr == "" {
+        return nil, ErrorClusterNoNode
+    }
+    return r.getNode(addr).PubSubConn()
+}
+
+//分片节点之间互相独立, 发布和订阅都约定使用第一个节点
+func (r *ShardedRedis) PubSubConn() (redis.Conn, error) {
+    return r.nodes[0].PubSubConn()
+}
+
+func (r *NearCacheRedis) PubSubConn() (redis.Conn, error) {
+    return r.backend.PubSubConn()
+}
+
+func (r *BreakerRedis) PubSubConn() (redis.Conn, error) {
+    ps, ok := r.backend.(IPubSubRedis)
+    if !ok {
+        return nil, ErrorPubSubNotSupported
+    }
+    allowed, probe := r.allow()
+    if !allowed {
+        return nil, ErrorCircuitOpen
+    }
+    c, err := ps.PubSubConn()
+    r.report(err, probe)
+    return c, err
+}
+
+//redisSubscription 同一组频道共用的订阅连接, channels 已加上命名空间前缀
+type redisSubscription struct {
+    id          string
+    prefix      string
+    channels    []interface{}
+    pattern     bool
+    conn        redis.PubSubConn
+    subscribers map[string]*pushTarget
+    closed      bool
+}
+
+func (rs *redisSubscription) names() string {
+    names := make([]string, len(rs.channels))
+    for i, c := range rs.channels {
+        names[i] = redisArgString(c)
+    }
+    return strings.Join(names, ",")
+}
+
+//RedisSubscriptions 把客户端的订阅合并到共享的 PubSubConn 上. 订阅相同频道集合的客户端共用一条连接,
+//收到的消息异步推送给每个订阅者; 连接中断后自动重连并重新订阅, 最后一个订阅者退出时关闭连接.
+//频道名加上订阅者所在命名空间的前缀, 推送时去掉前缀
+type RedisSubscriptions struct {
+    subs  map[string]*redisSubscription
+    mutex sync.Mutex
+}
+
+func CreateRedisSubscriptions() *RedisSubscriptions {
+    s := new(RedisSubscriptions)
+    s.subs = make(map[string]*redisSubscription)
+    go s.reapSubscribers()
+    return s
+}
+
+func redisSubscriptionId(prefix string, channels []string, pattern bool) string {
+    sorted := make([]string, len(channels))
+    for i, c := range channels {
+        sorted[i] = prefix + c
+    }
+    sort.Strings(sorted)
+    kind := "c:"
+    if pattern {
+        kind = "p:"
+    }
+    //前缀单独计入, 避免不同命名空间的订阅者共用连接后去掉错误的前缀
+    return kind + prefix + "\n" + strings.Join(sorted, "\n")
+}
+
+func (s *RedisSubscriptions) Subscribe(sub *pushTarget, prefix string, channels []string, pattern bool) error {
+    id := redisSubscriptionId(prefix, channels, pattern)
+    s.mutex.Lock()
+    rs, ok := s.subs[id]
+    if ok {
+        rs.subscribers[sub.owner] = sub
+        s.mutex.Unlock()
+        return nil
+    }
+    s.mutex.Unlock()
+
+    rs = &redisSubscription{id: id, prefix: prefix, pattern: pattern, subscribers: make(map[string]*pushTarget)}
+    rs.channels = make([]interface{}, len(channels))
+    for i, c := range channels {
+        rs.channels[i] = prefix + c
+    }
+    //建立连接不持有 mutex, 避免Redis不可用时阻塞其它订阅和推送
+    conn, err := s.connect(rs)
+    if err != nil {
+        return err
+    }
+
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    exists, ok := s.subs[id]
+    if ok {
+        //并发的订阅已经建立了相同的连接
+        conn.Close()
+        exists.subscribers[sub.owner] = sub
+        return nil
+    }
+    rs.conn = conn
+    rs.subscribers[sub.owner] = sub
+    s.subs[id] = rs
+    go s.receive(rs)
+    utils.LogInfo("Redis订阅已建立: %s", rs.names())
+    return nil
+}
+
+//connect 建立订阅连接并订阅 rs 的频道, 调用方不能持有 mutex
+func (s *RedisSubscriptions) connect(rs *redisSubscription) (redis.PubSubConn, error) {
+    ps, ok := redisClient.(IPubSubRedis)
+    if !ok {
+        return redis.PubSubConn{}, ErrorPubSubNotSupported
+    }
+    c, err := ps.PubSubConn()
+    if err != nil {
+        return redis.PubSubConn{}, err
+    }
+    conn := redis.PubSubConn{Conn: c}
+    if rs.pattern {
+        err = conn.PSubscribe(rs.channels...)
+    } else {
+        err = conn.Subscribe(rs.channels...)
+    }
+    if err != nil {
+        c.Close()
+        return redis.PubSubConn{}, err
+    }
+    return conn, nil
+}
+
+//reconnect 连接中断后重连, 订阅已关闭时返回false
+func (s *RedisSubscriptions) reconnect(rs *redisSubscription) bool {
+    for {
+        s.mutex.Lock()
+        closed := rs.closed
+        s.mutex.Unlock()
+        if closed {
+            return false
+        }
+        conn, err := s.connect(rs)
+        if err != nil {
+            utils.LogError("Redis订阅连接中断, 重连失败: %s", err.Error())
+            time.Sleep(time.Second)
+            continue
+        }
+        s.mutex.Lock()
+        if rs.closed {
+            //重连期间最后一个订阅者已经退出
+            s.mutex.Unlock()
+            conn.Close()
+            return false
+        }
+        rs.conn = conn
+        s.mutex.Unlock()
+        return true
+    }
+}
+
+func (s *RedisSubscriptions) receive(rs *redisSubscription) {
+    for {
+        s.mutex.Lock()
+        conn := rs.conn
+        s.mutex.Unlock()
+
+        //订阅连接取自连接池, 等待推送时不受 readTimeout 限制
+        switch v := conn.ReceiveWithTimeout(0).(type) {
+        case redis.Message:
+            body := make(codecs.IMMap)
+            body[ProtocolKeyChannel] = strings.TrimPrefix(v.Channel, rs.prefix)
+            body[messages.ProtocolKeyValue] = string(v.Data)
+            s.publish(rs, body)
+        case redis.PMessage:
+            body := make(codecs.IMMap)
+            body[ProtocolKeyChannel] = strings.TrimPrefix(v.Channel, rs.prefix)
+            body[ProtocolKeyPattern] = strings.TrimPrefix(v.Pattern, rs.prefix)
+            body[messages.ProtocolKeyValue] = string(v.Data)
+            s.publish(rs, body)
+        case error:
+            conn.Close()
+            if !s.reconnect(rs) {
+                return
+            }
+        }
+    }
+}
+
+func (s *RedisSubscriptions) publish(rs *redisSubscription, body codecs.IMMap) {
+    s.mutex.Lock()
+    subscribers := make([]*pushTarget, 0, len(rs.subscribers))
+    for _, sub := range rs.subscribers {
+        subscribers = append(subscribers, sub)
+    }
+    s.mutex.Unlock()
+    for _, sub := range subscribers {
+        sub.push(body)
+    }
+}
+
+//remove 移除订阅者, 调用方需持有 mutex
+func (s *RedisSubscriptions) remove(rs *redisSubscription, owner string) {
+    delete(rs.subscribers, owner)
+    if len(rs.subscribers) > 0 {
+        return
+    }
+    rs.closed = true
+    rs.conn.Close()
+    delete(s.subs, rs.id)
+    utils.LogInfo("Redis订阅已关闭: %s", rs.names())
+}
+
+func (s *RedisSubscriptions) Unsubscribe(owner string, prefix string, channels []string, pattern bool) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    rs, ok := s.subs[redisSubscriptionId(prefix, channels, pattern)]
+    if ok {
+        s.remove(rs, owner)
+    }
+}
+
+//CloseOwner 客户端断开时取消其全部订阅
+func (s *RedisSubscriptions) CloseOwner(owner string) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    for _, rs := range s.subs {
+        if _, ok := rs.subscribers[owner]; ok {
+            s.remove(rs, owner)
+        }
+    }
+}
+
+//unix 地址的订阅者没有断开通知, 定期检查地址是否仍然存在
+func (s *RedisSubscriptions) reapSubscribers() {
+    for range time.Tick(time.Second * 30) {
+        s.mutex.Lock()
+        for _, rs := range s.subs {
+            for owner, sub := range rs.subscribers {
+                if sub.unixAddr == "" {
+                    continue
+                }
+                _, err := os.Stat(sub.unixAddr)
+                if os.IsNotExist(err) {
+                    s.remove(rs, owner)
+                }
+            }
+        }
+        s.mutex.Unlock()
+    }
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "io/ioutil"
+    "sync"
+
+    "github.com/garyburd/redigo/redis"
+    "github.com/packing/clove/errors"
+)
+
+var (
+    redisTLSConfigs = make(map[RedisTLSConfig]*tls.Config)
+    redisTLSMutex   sync.Mutex
+)
+
+//redisTLSConfig 按配置加载证书并缓存, 同一配置只读取一次文件
+func redisTLSConfig(config RedisTLSConfig) (*tls.Config, error) {
+    redisTLSMutex.Lock()
+    defer redisTLSMutex.Unlock()
+    tc, ok := redisTLSConfigs[config]
+    if ok {
+        return tc, nil
+    }
+
+    tc = &tls.Config{ServerName: config.ServerName, InsecureSkipVerify: config.SkipVerify}
+    if config.CAFile != "" {
+        pem, err := ioutil.ReadFile(config.CAFile)
+        if err != nil {
+            return nil, err
+        }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(pem) {
+            return nil, errors.Errorf("no certificate found in %s", config.CAFile)
+        }
+        tc.RootCAs = pool
+    }
+    if config.CertFile != "" || config.KeyFile != "" {
+        cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+        if err != nil {
+            return nil, err
+        }
+        tc.Certificates = []tls.Certificate{cert}
+    }
+    redisTLSConfigs[config] = tc
+    return tc, nil
+}
+
+//redisTLSOptions 返回TLS相关的连接选项, 未启用TLS时返回空
+func redisTLSOptions(config RedisTLSConfig) ([]redis.DialOption, error) {
+    if !config.Enable {
+        return nil, nil
+    }
+    tc, err := redisTLSConfig(config)
+    if err != nil {
+        return nil, err
+    }
+    return []redis.DialOption{
+        redis.DialUseTLS(true),
+        redis.DialTLSConfig(tc),
+        redis.DialTLSSkipVerify(config.SkipVerify),
+    }, nil
+}
+
+//redisAuthACL 以ACL用户身份认证. 当前使用的 redigo 版本没有 DialUsername, 连接建立后手动发送 AUTH
+func redisAuthACL(c redis.Conn, username string, password string) error {
+    _, err := c.Do("AUTH", username, password)
+    if err != nil {
+        c.Close()
+    }
+    return err
+}
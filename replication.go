@@ -0,0 +1,633 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/packing/clove/codecs"
+    "github.com/packing/clove/errors"
+    "github.com/packing/clove/nnet"
+    "github.com/packing/clove/packets"
+    "github.com/packing/clove/utils"
+)
+
+const (
+    ReplicationRolePrimary = "primary"
+    ReplicationRoleReplica = "replica"
+)
+
+//复制协议消息的字段
+const (
+    replKeyType    = 0x01
+    replKeyReplId  = 0x02
+    replKeyOffset  = 0x03
+    replKeyCmd     = 0x04
+    replKeyArgs    = 0x05
+    replKeyData    = 0x06
+    replKeyKey     = 0x07
+    replKeyValue   = 0x08
+    replKeyExpire  = 0x09
+    replKeyDataTyp = 0x0a
+    replKeyMore    = 0x0b
+)
+
+//复制协议消息的类型
+const (
+    replTypeSync        = 0x01
+    replTypeFullResync  = 0x02
+    replTypeContinue    = 0x03
+    replTypeCommand     = 0x04
+    replTypeSnapshot    = 0x05
+    replTypeSnapshotEnd = 0x06
+    //编码后超出封包上限的消息被拆成多个分段, 副本收齐后再解码处理
+    replTypeFragment    = 0x07
+)
+
+//复制消息编码后的最大字节数. nnet 接收端每次只窥视1024字节来解析封包, 更大的封包无法被解出,
+//快照按此大小打包, 超出的消息拆成每段不超过此大小的 replTypeFragment
+const replPacketBytes = 768
+
+//会修改数据的命令, 主节点需要把这些命令同步给副本, 副本上则拒绝执行
+var localWriteCommands = map[string]bool{
+    REDIS_COMMAND_SET:         true,
+    REDIS_COMMAND_GETSET:      true,
+    REDIS_COMMAND_SETNX:       true,
+    REDIS_COMMAND_SETEX:       true,
+    REDIS_COMMAND_INCR:        true,
+    REDIS_COMMAND_INCRBY:      true,
+    REDIS_COMMAND_DECR:        true,
+    REDIS_COMMAND_DECRBY:      true,
+    REDIS_COMMAND_APPEND:      true,
+    REDIS_COMMAND_DEL:         true,
+    REDIS_COMMAND_MSET:        true,
+    REDIS_COMMAND_HSET:        true,
+    REDIS_COMMAND_HDEL:        true,
+    REDIS_COMMAND_HMSET:       true,
+    REDIS_COMMAND_HSETNX:      true,
+    REDIS_COMMAND_LPOP:        true,
+    REDIS_COMMAND_RPOP:        true,
+    REDIS_COMMAND_LPUSH:       true,
+    REDIS_COMMAND_RPUSH:       true,
+    REDIS_COMMAND_LSET:        true,
+    REDIS_COMMAND_LINSERT:     true,
+    REDIS_COMMAND_LINSERTAT:   true,
+    REDIS_COMMAND_LREM:        true,
+    REDIS_COMMAND_LREMAT:      true,
+    REDIS_COMMAND_LTRIM:       true,
+    REDIS_COMMAND_SADD:        true,
+    REDIS_COMMAND_SDIFFSTORE:  true,
+    REDIS_COMMAND_SINTERSTORE: true,
+    REDIS_COMMAND_SPOP:        true,
+    REDIS_COMMAND_SREM:        true,
+    REDIS_COMMAND_SUNIONSTORE: true,
+}
+
+var ErrorReadOnlyReplica = errors.Errorf("READONLY You can't write against a read only replica")
+
+type cacheReplication interface {
+    apply(cmd string, args []interface{}) (interface{}, error)
+    info() string
+}
+
+type replicationEntry struct {
+    offset int64
+    cmd    string
+    args   []interface{}
+    expire int64
+}
+
+func (r *LocalFastRedis) initReplication(config ReplicationConfig) {
+    switch config.Role {
+    case ReplicationRolePrimary:
+        p := new(cachePrimary)
+        p.cache = r
+        p.backlogSize = config.BacklogSize
+        if p.backlogSize <= 0 {
+            p.backlogSize = 100000
+        }
+        p.replId = newReplicationId()
+        p.replicas = make(map[nnet.SessionID]nnet.Controller)
+        p.syncing = make(map[nnet.SessionID]bool)
+        if p.listen(config.Listen) {
+            r.replication = p
+        }
+    case ReplicationRoleReplica:
+        rp := new(cacheReplica)
+        rp.cache = r
+        rp.primaryAddr = config.PrimaryAddr
+        r.replication = rp
+        go rp.connect()
+    case "":
+    default:
+        utils.LogWarn("redis配置节中复制角色role的配置值可能有误: %s", config.Role)
+    }
+}
+
+func newReplicationId() string {
+    b := make([]byte, 20)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
+
+//cachePrimary 主节点. 所有写命令在同一把锁内执行并追加到积压缓冲区, 保证副本看到的命令顺序与主节点执行顺序一致
+type cachePrimary struct {
+    cache       *LocalFastRedis
+    server      *nnet.TCPServer
+    replId      string
+    offset      int64
+    backlog     []replicationEntry
+    backlogSize int
+    replicas    map[nnet.SessionID]nnet.Controller
+    syncing     map[nnet.SessionID]bool
+    mutex       sync.Mutex
+}
+
+func (p *cachePrimary) listen(addr string) bool {
+    p.server = nnet.CreateTCPServer()
+    p.server.Codec = codecs.CodecIMv2
+    p.server.Format = packets.PacketFormatNB
+    p.server.OnDataDecoded = p.onData
+    p.server.OnBye = func(controller nnet.Controller) error {
+        p.mutex.Lock()
+        defer p.mutex.Unlock()
+        delete(p.replicas, controller.GetSessionID())
+        delete(p.syncing, controller.GetSessionID())
+        utils.LogInfo("副本 %s 已断开", controller.GetSource())
+        return nil
+    }
+    err := p.server.Bind(addr, 0)
+    if err != nil {
+        utils.LogError("!!! 无法在地址 %s 上开启复制监听: %s", addr, err.Error())
+        return false
+    }
+    p.server.Schedule()
+    utils.LogInfo("### 缓存复制主节点已就绪 %s, replid: %s", addr, p.replId)
+    return true
+}
+
+func (p *cachePrimary) apply(cmd string, args []interface{}) (interface{}, error) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    ret, err := p.cache.execute(cmd, args...)
+    if err == nil {
+        e := replicationEntry{}
+        e.cmd, e.args = rewriteForReplication(cmd, args, ret)
+        //副本按自己的时钟解释相对的过期时间会产生偏差, 同步主节点上实际的过期时刻
+        if cmd == REDIS_COMMAND_SETEX {
+            d := p.cache.getData(args[0])
+            if d != nil {
+                e.expire = poolDataExpire(d)
+            }
+        }
+        p.feed(e)
+    }
+    return ret, err
+}
+
+//SPOP 的结果是随机的, 以 SREM 的形式同步实际弹出的成员
+func rewriteForReplication(cmd string, args []interface{}, ret interface{}) (string, []interface{}) {
+    if cmd == REDIS_COMMAND_SPOP {
+        popped, _ := ret.([]interface{})
+        return REDIS_COMMAND_SREM, append([]interface{}{args[0]}, popped...)
+    }
+    return cmd, args
+}
+
+func (p *cachePrimary) feed(e replicationEntry) {
+    p.offset += 1
+    e.offset = p.offset
+    p.backlog = append(p.backlog, e)
+    if len(p.backlog) > p.backlogSize {
+        p.backlog = p.backlog[len(p.backlog)-p.backlogSize:]
+    }
+    if len(p.replicas) == 0 {
+        return
+    }
+    msgs, err := replicationPackets(commandMessage(e))
+    if err != nil {
+        //无法同步的命令会让副本与主节点不一致, 断开全部副本
+        utils.LogError("复制命令 %s 无法编码: %s, 断开全部副本", e.cmd, err.Error())
+        for id, c := range p.replicas {
+            delete(p.replicas, id)
+            c.Close()
+        }
+        return
+    }
+    for _, c := range p.replicas {
+        for _, msg := range msgs {
+            c.Send(msg)
+        }
+    }
+}
+
+//replicationPackets 返回实际发送的消息, 编码后超出 replPacketBytes 时拆成多个 replTypeFragment
+func replicationPackets(msg codecs.IMMap) ([]codecs.IMMap, error) {
+    var data codecs.IMData = msg
+    err, b := codecs.CodecIMv2.Encoder.Encode(&data)
+    if err != nil {
+        return nil, err
+    }
+    if len(b) <= replPacketBytes {
+        return []codecs.IMMap{msg}, nil
+    }
+    msgs := make([]codecs.IMMap, 0, len(b)/replPacketBytes+1)
+    for len(b) > 0 {
+        n := replPacketBytes
+        if n > len(b) {
+            n = len(b)
+        }
+        fragment := make(codecs.IMMap)
+        fragment[replKeyType] = replTypeFragment
+        fragment[replKeyData] = b[:n]
+        fragment[replKeyMore] = n < len(b)
+        msgs = append(msgs, fragment)
+        b = b[n:]
+    }
+    return msgs, nil
+}
+
+func sendReplication(controller nnet.Controller, msg codecs.IMMap) error {
+    msgs, err := replicationPackets(msg)
+    if err != nil {
+        return err
+    }
+    for _, m := range msgs {
+        controller.Send(m)
+    }
+    return nil
+}
+
+func commandMessage(e replicationEntry) codecs.IMMap {
+    msg := make(codecs.IMMap)
+    msg[replKeyType] = replTypeCommand
+    msg[replKeyOffset] = e.offset
+    msg[replKeyCmd] = e.cmd
+    msg[replKeyArgs] = codecs.IMSlice(e.args)
+    if e.expire > 0 {
+        msg[replKeyExpire] = e.expire
+    }
+    return msg
+}
+
+func (p *cachePrimary) onData(controller nnet.Controller, _ string, data codecs.IMData) error {
+    m, ok := data.(codecs.IMMap)
+    if !ok {
+        return nil
+    }
+    r := codecs.CreateMapReader(m)
+    if r.IntValueOf(replKeyType, 0) != replTypeSync {
+        return nil
+    }
+    replId := r.StrValueOf(replKeyReplId, "")
+    offset := r.IntValueOf(replKeyOffset, -1)
+
+    p.mutex.Lock()
+    if replId == p.replId && p.canContinue(offset) {
+        defer p.mutex.Unlock()
+        reply := make(codecs.IMMap)
+        reply[replKeyType] = replTypeContinue
+        reply[replKeyReplId] = p.replId
+        reply[replKeyOffset] = p.offset
+        controller.Send(reply)
+        err := p.sendBacklog(controller, offset)
+        if err != nil {
+            utils.LogError("副本 %s 部分重同步失败: %s", controller.GetSource(), err.Error())
+            controller.Close()
+            return nil
+        }
+        p.replicas[controller.GetSessionID()] = controller
+        utils.LogInfo("副本 %s 部分重同步, 从偏移 %d 继续", controller.GetSource(), offset)
+        return nil
+    }
+    //锁内只生成快照, 分片发送在锁外进行, 期间的写命令由积压缓冲区在发送完成后补齐
+    entries := p.cache.snapshot()
+    offset = p.offset
+    p.syncing[controller.GetSessionID()] = true
+    reply := make(codecs.IMMap)
+    reply[replKeyType] = replTypeFullResync
+    reply[replKeyReplId] = p.replId
+    reply[replKeyOffset] = offset
+    p.mutex.Unlock()
+
+    controller.Send(reply)
+    parts, err := splitSnapshot(entries)
+    for _, part := range parts {
+        if err != nil {
+            break
+        }
+        chunk := make(codecs.IMMap)
+        chunk[replKeyType] = replTypeSnapshot
+        chunk[replKeyData] = part
+        err = sendReplication(controller, chunk)
+    }
+    if err != nil {
+        //缺少任何一个key都不能算作完成同步, 断开后由副本重新发起
+        utils.LogError("副本 %s 全量同步失败: %s", controller.GetSource(), err.Error())
+        p.mutex.Lock()
+        delete(p.syncing, controller.GetSessionID())
+        p.mutex.Unlock()
+        controller.Close()
+        return nil
+    }
+    done := make(codecs.IMMap)
+    done[replKeyType] = replTypeSnapshotEnd
+    done[replKeyOffset] = offset
+    controller.Send(done)
+
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    if !p.syncing[controller.GetSessionID()] {
+        return nil
+    }
+    delete(p.syncing, controller.GetSessionID())
+    if !p.canContinue(offset) {
+        utils.LogWarn("副本 %s 全量同步期间积压缓冲区已溢出, 断开后重新同步", controller.GetSource())
+        controller.Close()
+        return nil
+    }
+    err = p.sendBacklog(controller, offset)
+    if err != nil {
+        utils.LogError("副本 %s 全量同步失败: %s", controller.GetSource(), err.Error())
+        controller.Close()
+        return nil
+    }
+    p.replicas[controller.GetSessionID()] = controller
+    utils.LogInfo("副本 %s 全量同步, 共 %d 个key, 偏移 %d", controller.GetSource(), len(entries), offset)
+    return nil
+}
+
+//splitSnapshot 按编码后的大小把快照打包成多个分片, 单个key超出上限时独占一个分片, 发送时再拆成分段.
+//任何key无法编码时返回错误
+func splitSnapshot(entries codecs.IMSlice) ([]codecs.IMSlice, error) {
+    parts := make([]codecs.IMSlice, 0)
+    part := make(codecs.IMSlice, 0)
+    size := 0
+    for _, e := range entries {
+        err, b := codecs.CodecIMv2.Encoder.Encode(&e)
+        if err != nil {
+            key := codecs.CreateMapReader(e.(codecs.IMMap)).TryReadValue(replKeyKey)
+            return nil, fmt.Errorf("key %v cannot be encoded: %s", key, err.Error())
+        }
+        if size > 0 && size+len(b) > replPacketBytes {
+            parts = append(parts, part)
+            part = make(codecs.IMSlice, 0)
+            size = 0
+        }
+        part = append(part, e)
+        size += len(b)
+    }
+    if len(part) > 0 {
+        parts = append(parts, part)
+    }
+    return parts, nil
+}
+
+//sendBacklog 调用方需持有 mutex
+func (p *cachePrimary) sendBacklog(controller nnet.Controller, offset int64) error {
+    for _, e := range p.backlog {
+        if e.offset > offset {
+            err := sendReplication(controller, commandMessage(e))
+            if err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+func (p *cachePrimary) canContinue(offset int64) bool {
+    if offset < 0 || offset > p.offset {
+        return false
+    }
+    if offset == p.offset {
+        return true
+    }
+    return len(p.backlog) > 0 && p.backlog[0].offset <= offset+1
+}
+
+//cacheReplica 副本节点. 只接受读命令, 写入仅来自主节点的复制流
+type cacheReplica struct {
+    cache       *LocalFastRedis
+    primaryAddr string
+    client      *nnet.TCPClient
+    replId      string
+    offset      int64
+    loaded      int
+    syncReplId  string
+    fragments   []byte
+    mutex       sync.Mutex
+}
+
+func (rp *cacheReplica) apply(string, []interface{}) (interface{}, error) {
+    return nil, ErrorReadOnlyReplica
+}
+
+func (rp *cacheReplica) connect() {
+    for {
+        closed := make(chan int)
+        client := nnet.CreateTCPClient(packets.PacketFormatNB, codecs.CodecIMv2)
+        client.OnDataDecoded = rp.onData
+        client.OnBye = func(nnet.Controller) error {
+            close(closed)
+            return nil
+        }
+        err := client.Connect(rp.primaryAddr, 0)
+        if err == nil {
+            rp.mutex.Lock()
+            msg := make(codecs.IMMap)
+            msg[replKeyType] = replTypeSync
+            msg[replKeyReplId] = rp.replId
+            msg[replKeyOffset] = rp.offset
+            rp.fragments = nil
+            rp.mutex.Unlock()
+            client.Send(msg)
+            <-closed
+            utils.LogWarn("与复制主节点 %s 的连接已断开", rp.primaryAddr)
+        }
+        time.Sleep(time.Second)
+    }
+}
+
+func (rp *cacheReplica) onData(controller nnet.Controller, _ string, data codecs.IMData) error {
+    m, ok := data.(codecs.IMMap)
+    if !ok {
+        return nil
+    }
+    rp.mutex.Lock()
+    defer rp.mutex.Unlock()
+    rp.handle(controller, m)
+    return nil
+}
+
+//handle 处理一条复制消息, 调用方需持有 mutex
+func (rp *cacheReplica) handle(controller nnet.Controller, m codecs.IMMap) {
+    r := codecs.CreateMapReader(m)
+    switch r.IntValueOf(replKeyType, 0) {
+    case replTypeFragment:
+        b, _ := r.TryReadValue(replKeyData).([]byte)
+        rp.fragments = append(rp.fragments, b...)
+        if r.BoolValueOf(replKeyMore) {
+            return
+        }
+        err, data, _ := codecs.CodecIMv2.Decoder.Decode(rp.fragments)
+        rp.fragments = nil
+        whole, ok := data.(codecs.IMMap)
+        if err != nil || !ok {
+            //丢弃后数据将不完整, 断开后重新同步
+            utils.LogError("无法解码来自主节点 %s 的分段消息, 断开后重新同步", rp.primaryAddr)
+            controller.Close()
+            return
+        }
+        rp.handle(controller, whole)
+    case replTypeFullResync:
+        rp.cache.clearData()
+        //快照收齐之前断开时不能部分重同步, replid 在 replTypeSnapshotEnd 时才生效
+        rp.replId = ""
+        rp.syncReplId = r.StrValueOf(replKeyReplId, "")
+        rp.offset = r.IntValueOf(replKeyOffset, 0)
+        rp.loaded = 0
+    case replTypeSnapshot:
+        entries, _ := r.TryReadValue(replKeyData).(codecs.IMSlice)
+        rp.cache.loadSnapshot(entries)
+        rp.loaded += len(entries)
+    case replTypeSnapshotEnd:
+        rp.replId = rp.syncReplId
+        utils.LogInfo("已从主节点 %s 完成全量同步, 共 %d 个key, 偏移 %d", rp.primaryAddr, rp.loaded, rp.offset)
+    case replTypeContinue:
+        rp.replId = r.StrValueOf(replKeyReplId, "")
+        utils.LogInfo("已与主节点 %s 部分重同步, 偏移 %d", rp.primaryAddr, rp.offset)
+    case replTypeCommand:
+        offset := r.IntValueOf(replKeyOffset, 0)
+        if offset <= rp.offset {
+            return
+        }
+        cmd := r.StrValueOf(replKeyCmd, "")
+        args, _ := r.TryReadValue(replKeyArgs).(codecs.IMSlice)
+        _, err := rp.cache.execute(cmd, args...)
+        if err != nil {
+            utils.LogWarn("副本执行复制命令 %s 失败: %s", cmd, err.Error())
+        } else if expire := r.IntValueOf(replKeyExpire, 0); expire > 0 && len(args) > 0 {
+            rp.cache.setLifeCycle(args[0], expire)
+        }
+        rp.offset = offset
+    }
+}
+
+func (r *LocalFastRedis) snapshot() codecs.IMSlice {
+    entries := make(codecs.IMSlice, 0)
+    r.dataPool.Range(func(key, value interface{}) bool {
+        d, ok := value.(IPoolData)
+        if !ok || !d.CheckAlive() {
+            return true
+        }
+        e := make(codecs.IMMap)
+        e[replKeyKey] = key
+        e[replKeyDataTyp] = int(d.GetDataType())
+        e[replKeyExpire] = poolDataExpire(d)
+        switch d.GetDataType() {
+        case REDIS_TYPE_STANDARD:
+            e[replKeyValue] = d.GetValue()
+        case REDIS_TYPE_MAP:
+            m := make(codecs.IMMap)
+            for _, k := range d.GetKeys() {
+                m[k] = d.GetKeyValue(k)
+            }
+            e[replKeyValue] = m
+        case REDIS_TYPE_LIST, REDIS_TYPE_SET:
+            vs := d.GetValues()
+            l := make(codecs.IMSlice, len(vs))
+            copy(l, vs)
+            e[replKeyValue] = l
+        }
+        entries = append(entries, e)
+        return true
+    })
+    return entries
+}
+
+func (r *LocalFastRedis) clearData() {
+    r.dataPool.Range(func(key, value interface{}) bool {
+        r.dataPool.Delete(key)
+        return true
+    })
+}
+
+func (r *LocalFastRedis) loadSnapshot(entries codecs.IMSlice) {
+    for _, ie := range entries {
+        m, ok := ie.(codecs.IMMap)
+        if !ok {
+            continue
+        }
+        er := codecs.CreateMapReader(m)
+        key := er.TryReadValue(replKeyKey)
+        value := er.TryReadValue(replKeyValue)
+        var d IPoolData
+        switch er.IntValueOf(replKeyDataTyp, REDIS_TYPE_STANDARD) {
+        case REDIS_TYPE_STANDARD:
+            d = r.ensureStandardData(key)
+            d.SetValue(value)
+        case REDIS_TYPE_MAP:
+            d = r.ensureMapData(key)
+            kvs, _ := value.(codecs.IMMap)
+            for k, v := range kvs {
+                d.SetKeyValue(k, v)
+            }
+        case REDIS_TYPE_LIST:
+            d = r.ensureListData(key)
+            vs, _ := value.(codecs.IMSlice)
+            for _, v := range vs {
+                d.AppendValue(v)
+            }
+        case REDIS_TYPE_SET:
+            d = r.ensureSetData(key)
+            vs, _ := value.(codecs.IMSlice)
+            d.BuildSet(vs...)
+        default:
+            continue
+        }
+        d.SetLifeCycle(er.IntValueOf(replKeyExpire, 0))
+    }
+}
+
+func poolDataExpire(d IPoolData) int64 {
+    switch v := d.(type) {
+    case *StandardData:
+        v.mutex.Lock()
+        defer v.mutex.Unlock()
+        return v.expire
+    case *MapData:
+        v.mutex.Lock()
+        defer v.mutex.Unlock()
+        return v.expire
+    case *ListData:
+        v.mutex.Lock()
+        defer v.mutex.Unlock()
+        return v.expire
+    case *SetData:
+        return v.expire
+    }
+    return 0
+}
+
+func (rp *cacheReplica) info() string {
+    rp.mutex.Lock()
+    defer rp.mutex.Unlock()
+    return fmt.Sprintf("role:slave\r\nmaster_host:%s\r\nmaster_replid:%s\r\nslave_repl_offset:%d\r\n",
+        rp.primaryAddr, rp.replId, rp.offset)
+}
+
+func (p *cachePrimary) info() string {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    var b strings.Builder
+    fmt.Fprintf(&b, "role:master\r\nconnected_slaves:%d\r\nmaster_replid:%s\r\nmaster_repl_offset:%d\r\n",
+        len(p.replicas), p.replId, p.offset)
+    if len(p.backlog) > 0 {
+        fmt.Fprintf(&b, "repl_backlog_first_byte_offset:%d\r\nrepl_backlog_histlen:%d\r\n", p.backlog[0].offset, len(p.backlog))
+    }
+    return b.String()
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+
+    "github.com/garyburd/redigo/redis"
+    "github.com/packing/clove/codecs"
+)
+
+//统一的应答模型, 两种后端经转换后返回相同的类型:
+//  nil            key不存在或Redis的nil应答, 不再作为错误返回
+//  string         状态应答("OK")与字符串应答, []byte 一律转换为 string
+//  int64          整数应答, 本地缓存返回的各种整数类型以及bool(1/0)
+//  string         浮点数按Redis的格式转换为字符串
+//  []interface{}  数组应答, 元素递归转换
+//  error          错误应答, 本地缓存的错误转换为与Redis一致的错误文本
+//  IMMap          数组中的错误元素(如EXEC的应答), 错误文本在 ProtocolKeyError 中, 与普通字符串区分
+//valueCodec 解码出来的复合值(IMMap等)保持原样
+
+var (
+    replyErrorWrongType = redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+    replyErrorNoSuchKey = redis.Error("ERR no such key")
+)
+
+//本地缓存中以非状态值表示成功, 而Redis返回 "OK" 的命令
+var replyStatusCommands = map[string]bool{
+    REDIS_COMMAND_SET:   true,
+    REDIS_COMMAND_SETEX: true,
+    REDIS_COMMAND_MSET:  true,
+    REDIS_COMMAND_HMSET: true,
+    REDIS_COMMAND_LSET:  true,
+    REDIS_COMMAND_LTRIM: true,
+    "flushall":          true,
+    "flushdb":           true,
+}
+
+//本地缓存返回 ErrorKeyNotFound 时, Redis对应命令的应答; 未列出的命令为nil
+var replyMissingKey = map[string]interface{}{
+    REDIS_COMMAND_HLEN:      int64(0),
+    REDIS_COMMAND_HSETNX:    int64(0),
+    REDIS_COMMAND_LLEN:      int64(0),
+    REDIS_COMMAND_LREM:      int64(0),
+    REDIS_COMMAND_LINSERT:   int64(0),
+    REDIS_COMMAND_LINSERTAT: int64(0),
+    REDIS_COMMAND_LREMAT:    int64(0),
+    REDIS_COMMAND_LRANGE:    []interface{}{},
+    REDIS_COMMAND_LTRIM:     "OK",
+}
+
+func normalizeError(cmd string, err error) (interface{}, error) {
+    switch err {
+    case ErrorKeyNotFound:
+        if cmd == REDIS_COMMAND_LSET {
+            return nil, replyErrorNoSuchKey
+        }
+        return replyMissingKey[cmd], nil
+    case ErrorTypeNotMatch:
+        return nil, replyErrorWrongType
+    case ErrorArgsLength:
+        return nil, redis.Error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd))
+    }
+    return nil, err
+}
+
+func normalizeValue(v interface{}) interface{} {
+    switch d := v.(type) {
+    case nil:
+        return nil
+    case string:
+        return d
+    case []byte:
+        return string(d)
+    case int64:
+        return d
+    case int:
+        return int64(d)
+    case int8:
+        return int64(d)
+    case int16:
+        return int64(d)
+    case int32:
+        return int64(d)
+    case uint:
+        return int64(d)
+    case uint8:
+        return int64(d)
+    case uint16:
+        return int64(d)
+    case uint32:
+        return int64(d)
+    case uint64:
+        return int64(d)
+    case bool:
+        if d {
+            return int64(1)
+        }
+        return int64(0)
+    case float32:
+        return strconv.FormatFloat(float64(d), 'f', -1, 32)
+    case float64:
+        return strconv.FormatFloat(d, 'f', -1, 64)
+    case redis.Error:
+        return codecs.IMMap{ProtocolKeyError: d.Error()}
+    case []interface{}:
+        ret := make([]interface{}, len(d))
+        for i, e := range d {
+            ret[i] = normalizeValue(e)
+        }
+        return ret
+    }
+    return v
+}
+
+//normalizeReply 把任一后端的应答转换为统一的应答模型
+func normalizeReply(cmd string, reply interface{}, err error) (interface{}, error) {
+    cmd = strings.ToLower(cmd)
+    if err != nil {
+        if _, ok := err.(redis.Error); ok {
+            return nil, err
+        }
+        return normalizeError(cmd, err)
+    }
+    if replyStatusCommands[cmd] && reply != nil {
+        return "OK", nil
+    }
+    return normalizeValue(reply), nil
+}
+
+//CanonicalRedis 在任一 IRedis 实现外转换应答, 配置 canonicalReplies 时才启用, 默认保持旧的应答以兼容现有客户端
+type CanonicalRedis struct {
+    backend IRedis
+}
+
+func (r *CanonicalRedis) InitPool(config RedisConfig) {
+    r.backend.InitPool(config)
+}
+
+func (r *CanonicalRedis) OpenConn(key uint64, owner string) bool {
+    return r.backend.OpenConn(key, owner)
+}
+
+func (r *CanonicalRedis) CloseConn(key uint64) {
+    r.backend.CloseConn(key)
+}
+
+func (r *CanonicalRedis) CloseOwnerConns(owner string) {
+    r.backend.CloseOwnerConns(owner)
+}
+
+func (r *CanonicalRedis) Do(cmd string, args ...interface{}) (interface{}, error) {
+    ret, err := r.backend.Do(cmd, args...)
+    return normalizeReply(cmd, ret, err)
+}
+
+func (r *CanonicalRedis) DoReplica(cmd string, args ...interface{}) (interface{}, error) {
+    replica, ok := r.backend.(IReplicaRedis)
+    if !ok {
+        return r.Do(cmd, args...)
+    }
+    ret, err := replica.DoReplica(cmd, args...)
+    return normalizeReply(cmd, ret, err)
+}
+
+func (r *CanonicalRedis) PubSubConn() (redis.Conn, error) {
+    ps, ok := r.backend.(IPubSubRedis)
+    if !ok {
+        return nil, ErrorPubSubNotSupported
+    }
+    return ps.PubSubConn()
+}
+
+func (r *CanonicalRedis) Send(key uint64, owner string, cmd string, args ...interface{}) error {
+    return r.backend.Send(key, owner, cmd, args...)
+}
+
+func (r *CanonicalRedis) Flush(key uint64, owner string) error {
+    return r.backend.Flush(key, owner)
+}
+
+//管道应答只来自Redis, 只需要做类型转换
+func (r *CanonicalRedis) Receive(key uint64, owner string) (interface{}, error) {
+    ret, err := r.backend.Receive(key, owner)
+    return normalizeReply("", ret, err)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+
+    "github.com/garyburd/redigo/redis"
+    "github.com/packing/clove/codecs"
+)
+
+func TestNormalizeReply(t *testing.T) {
+    cases := []struct {
+        cmd   string
+        reply interface{}
+        err   error
+        want  interface{}
+        werr  error
+    }{
+        //Redis 的应答
+        {"get", []byte("v"), nil, "v", nil},
+        {"get", nil, nil, nil, nil},
+        {"incr", int64(3), nil, int64(3), nil},
+        {"set", "OK", nil, "OK", nil},
+        {"mget", []interface{}{[]byte("a"), nil}, nil, []interface{}{"a", nil}, nil},
+        {"get", nil, redis.Error("WRONGTYPE x"), nil, redis.Error("WRONGTYPE x")},
+        //数组中的错误带有标记, 与普通字符串区分
+        {"exec", []interface{}{"OK", redis.Error("ERR x")}, nil, []interface{}{"OK", codecs.IMMap{ProtocolKeyError: "ERR x"}}, nil},
+        //本地缓存的应答
+        {"set", true, nil, "OK", nil},
+        {"SETEX", int64(1), nil, "OK", nil},
+        {"hlen", 5, nil, int64(5), nil},
+        {"sismember", true, nil, int64(1), nil},
+        {"sismember", false, nil, int64(0), nil},
+        {"incrbyfloat", 1.5, nil, "1.5", nil},
+        {"incrbyfloat", float32(2.25), nil, "2.25", nil},
+        {"lrange", []interface{}{1, "b", []byte("c")}, nil, []interface{}{int64(1), "b", "c"}, nil},
+        //本地缓存的错误转换为Redis的应答
+        {"get", nil, ErrorKeyNotFound, nil, nil},
+        {"hlen", nil, ErrorKeyNotFound, int64(0), nil},
+        {"lrange", nil, ErrorKeyNotFound, []interface{}{}, nil},
+        {"ltrim", nil, ErrorKeyNotFound, "OK", nil},
+        {"lset", nil, ErrorKeyNotFound, nil, replyErrorNoSuchKey},
+        {"get", nil, ErrorTypeNotMatch, nil, replyErrorWrongType},
+        {"hset", nil, ErrorArgsLength, nil, redis.Error("ERR wrong number of arguments for 'hset' command")},
+    }
+    for _, c := range cases {
+        got, err := normalizeReply(c.cmd, c.reply, c.err)
+        if !reflect.DeepEqual(got, c.want) || err != c.werr {
+            t.Errorf("normalizeReply(%s, %#v, %v) = %#v, %v, want %#v, %v", c.cmd, c.reply, c.err, got, err, c.want, c.werr)
+        }
+    }
+}
@@ -0,0 +1,53 @@
+#!/bin/sh
+#在本机以多个 redis-server 进程启动一个测试用的 Redis Cluster, 供 storage 的集群模式联调.
+#
+#用法:
+#  scripts/redis-cluster.sh start [起始端口] [主节点数] [每个主节点的副本数]
+#  scripts/redis-cluster.sh stop  [起始端口] [主节点数] [每个主节点的副本数]
+#
+#默认在 7000 起的端口上启动 3 个主节点, 每个主节点 1 个副本, 数据目录位于 ${CLUSTER_DIR:-/tmp/storage-cluster}.
+#启动后在 storage.conf 的 redis 配置节中设置:
+#  "cluster": true,
+#  "nodes": ["127.0.0.1:7000", "127.0.0.1:7001", "127.0.0.1:7002"]
+
+set -e
+
+ACTION=${1:-start}
+PORT=${2:-7000}
+MASTERS=${3:-3}
+REPLICAS=${4:-1}
+DIR=${CLUSTER_DIR:-/tmp/storage-cluster}
+COUNT=$((MASTERS * (REPLICAS + 1)))
+LAST=$((PORT + COUNT - 1))
+
+case "$ACTION" in
+start)
+    mkdir -p "$DIR"
+    NODES=""
+    for p in $(seq "$PORT" "$LAST"); do
+        mkdir -p "$DIR/$p"
+        redis-server --port "$p" --dir "$DIR/$p" --daemonize yes \
+            --cluster-enabled yes --cluster-config-file nodes.conf \
+            --cluster-node-timeout 5000 --appendonly no \
+            --logfile "$DIR/$p/redis.log" --pidfile "$DIR/$p/redis.pid"
+        NODES="$NODES 127.0.0.1:$p"
+    done
+    #等待全部进程开始监听
+    for p in $(seq "$PORT" "$LAST"); do
+        until redis-cli -p "$p" ping >/dev/null 2>&1; do
+            sleep 0.1
+        done
+    done
+    redis-cli --cluster create $NODES --cluster-replicas "$REPLICAS" --cluster-yes
+    ;;
+stop)
+    for p in $(seq "$PORT" "$LAST"); do
+        redis-cli -p "$p" shutdown nosave >/dev/null 2>&1 || true
+    done
+    rm -rf "$DIR"
+    ;;
+*)
+    echo "usage: $0 start|stop [port] [masters] [replicas]" >&2
+    exit 1
+    ;;
+esac